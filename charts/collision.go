@@ -0,0 +1,178 @@
+package charts
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+type CollisionPolicy int
+
+const (
+	// each of the images gets a column of its own
+	SpreadCollisions CollisionPolicy = iota
+	// keep the image whose file was modified last
+	KeepNewest
+	// keep the first image in the order of the tie break variable
+	KeepFirst
+	// stack the images in the cell, to be flipped through
+	StackCollisions
+	FailOnCollision
+)
+
+// Collisions is what to do when several images land in the same cell of a
+// chart, eg. a region which was captured twice.
+type Collisions struct {
+	Policy CollisionPolicy
+	TieBreak string
+}
+
+// Collision is a cell of a chart with more than one image.
+type Collision struct {
+	Row, Column ingest.Metadata
+	Images []*ingest.Image
+}
+
+// ParseCollisions parses columns, newest, first:<var>, stack or fail.
+func ParseCollisions(s string) (*Collisions, error) {
+	switch {
+	case s == "" || s == "columns":
+		return &Collisions{Policy: SpreadCollisions}, nil
+	case s == "newest":
+		return &Collisions{Policy: KeepNewest}, nil
+	case strings.HasPrefix(s, "first:") && len(s) > len("first:"):
+		return &Collisions{Policy: KeepFirst, TieBreak: strings.TrimPrefix(s, "first:")}, nil
+	case s == "stack":
+		return &Collisions{Policy: StackCollisions}, nil
+	case s == "fail":
+		return &Collisions{Policy: FailOnCollision}, nil
+	default:
+		return nil, fmt.Errorf("unknown collision policy '%v' (expected columns, newest, first:<var>, stack or fail)", s)
+	}
+}
+
+func (c *Collisions) String() string {
+	switch c.Policy {
+	case SpreadCollisions:
+		return "columns"
+	case KeepNewest:
+		return "newest"
+	case KeepFirst:
+		return "first:" + c.TieBreak
+	case StackCollisions:
+		return "stack"
+	case FailOnCollision:
+		return "fail"
+	default:
+		return fmt.Sprintf("<collision-policy %d>", int(c.Policy))
+	}
+}
+
+func (c *Collision) String() string {
+	paths := make([]string, 0, len(c.Images))
+	for _, img := range c.Images {
+		paths = append(paths, filepath.Base(img.Path))
+	}
+	return fmt.Sprintf("row %v column %v has %d images: %v", c.Row, c.Column, len(c.Images), strings.Join(paths, ", "))
+}
+
+// resolve finds the cells of the row with more than one image and applies the
+// policy to them. A nil Collisions spreads the images over columns.
+func (c *Collisions) resolve(row *Row, columnOn []string, orders Orders) ([]*Collision, error) {
+	policy := SpreadCollisions
+	if c != nil {
+		policy = c.Policy
+	}
+	cells := make(map[string][]*ingest.Image, len(row.images))
+	order := make([]string, 0, len(row.images))
+	for _, img := range row.images {
+		k := metaKey(Submeta(img.Meta(), columnOn))
+		if _, has := cells[k]; !has {
+			order = append(order, k)
+		}
+		cells[k] = append(cells[k], img)
+	}
+	var collisions []*Collision
+	images := make([]*ingest.Image, 0, len(row.images))
+	for _, k := range order {
+		cell := cells[k]
+		if len(cell) == 1 {
+			images = append(images, cell[0])
+			continue
+		}
+		collisions = append(collisions, &Collision{
+			Row: row.meta,
+			Column: Submeta(cell[0].Meta(), columnOn),
+			Images: cell,
+		})
+		switch policy {
+		case SpreadCollisions:
+			images = append(images, cell...)
+		case KeepNewest:
+			images = append(images, newest(cell))
+		case KeepFirst:
+			images = append(images, OrderBy(imageListAsImages(cell), []string{c.TieBreak}, orders)[0].(*ingest.Image))
+		case StackCollisions:
+			images = append(images, cell[0])
+			if row.stacks == nil {
+				row.stacks = make(map[*ingest.Image][]*ingest.Image)
+			}
+			row.stacks[cell[0]] = cell
+		case FailOnCollision:
+			return nil, fmt.Errorf("more than one image in a cell: %v", collisions[len(collisions)-1])
+		}
+	}
+	row.images = images
+	return collisions, nil
+}
+
+// keepStacks keeps the stacks (see StackCollisions) of the images of the row.
+func (r *Row) keepStacks(stacks map[*ingest.Image][]*ingest.Image) {
+	for _, img := range r.images {
+		if stack, has := stacks[img]; has {
+			if r.stacks == nil {
+				r.stacks = make(map[*ingest.Image][]*ingest.Image)
+			}
+			r.stacks[img] = stack
+		}
+	}
+}
+
+// newest is the image whose source file (or preview if it has no source) was
+// modified last. Images which can not be stat'ed are the oldest.
+func newest(images []*ingest.Image) *ingest.Image {
+	var best *ingest.Image
+	var bestTime int64
+	for _, img := range images {
+		path := img.Source
+		if path == "" {
+			path = img.Path
+		}
+		t := int64(-1)
+		if fi, err := os.Stat(path); err == nil {
+			t = fi.ModTime().UnixNano()
+		}
+		if best == nil || t > bestTime {
+			best, bestTime = img, t
+		}
+	}
+	return best
+}
+
+// CollisionSummary lists the cells of the charts with more than one image,
+// one line per cell.
+func CollisionSummary(charts []*Chart) string {
+	var lines []string
+	for _, chart := range charts {
+		for _, c := range chart.collisions {
+			lines = append(lines, fmt.Sprintf("chart %v %v", chart.Meta(), c))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
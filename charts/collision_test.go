@@ -0,0 +1,162 @@
+package charts
+
+import "testing"
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+func TestCollisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var images []*ingest.Image
+	for i, capture := range []string{"2", "1", "3"} {
+		path := filepath.Join(dir, "L1 DAPI " + capture + ".jpg")
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the last capture is the newest
+		at := time.Now().Add(-time.Duration(i) * time.Hour)
+		if capture == "3" {
+			at = time.Now().Add(time.Hour)
+		}
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, &ingest.Image{
+			Path: path,
+			Metadata: ingest.Metadata{"slide": "1", "region": "L1", "stain": "DAPI", "capture": capture},
+		})
+	}
+	images = append(images, &ingest.Image{Path: "L1 FITC", Metadata: ingest.Metadata{"slide": "1", "region": "L1", "stain": "FITC"}})
+	layout := func(policy string) (*Chart, error) {
+		c, err := ParseCollisions(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &Layout{Charts: []string{"slide"}, Rows: []string{"region"}, Columns: []string{"stain"}, Collisions: c}
+		root, err := MakeLayout(images, l, nil)
+		if err != nil {
+			return nil, err
+		}
+		return root.AllCharts()[0], nil
+	}
+	cells := func(chart *Chart) []*ingest.Image {
+		if len(chart.Collisions()) != 1 || len(chart.Collisions()[0].Images) != 3 {
+			t.Fatal("expected one collision of the DAPI captures", chart.Collisions())
+		}
+		return chart.Rows()[0].Images()
+	}
+	chart, err := layout("columns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells(chart)) != 4 {
+		t.Fatal("expected a column per image", chart.Rows()[0].Images())
+	}
+	chart, err = layout("newest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := cells(chart); len(row) != 2 || row[0].Meta()["capture"] != "3" {
+		t.Fatal("expected the newest capture", row)
+	}
+	chart, err = layout("first:capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := cells(chart); len(row) != 2 || row[0].Meta()["capture"] != "1" {
+		t.Fatal("expected the first capture", row)
+	}
+	chart, err = layout("stack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := cells(chart); len(row) != 2 || len(chart.Rows()[0].Stack(row[0])) != 3 || chart.Rows()[0].Stack(row[1]) != nil {
+		t.Fatal("expected the captures stacked in one cell", row)
+	}
+	if _, err := layout("fail"); err == nil {
+		t.Fatal("expected the fail policy to fail")
+	}
+	if _, err := ParseCollisions("first:"); err == nil {
+		t.Fatal("expected an error for first without a variable")
+	}
+}
+
+func TestCollisionsBeforeOverlays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var images []*ingest.Image
+	for i, name := range []string{"L1 DAPI 1", "L1 DAPI 2", "L1 FITC"} {
+		path := filepath.Join(dir, name + ".png")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = png.Encode(f, speckles(40, 30, 10, image.Pt(i, 0)))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := ingest.Metadata{"slide": "1", "region": "L1", "stain": "FITC"}
+		if i < 2 {
+			meta["stain"] = "DAPI"
+			meta["capture"] = fmt.Sprint(i + 1)
+		}
+		images = append(images, &ingest.Image{Path: path, Metadata: meta})
+	}
+	layout := func(policy string) (*Chart, error) {
+		c, err := ParseCollisions(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &Layout{
+			Charts: []string{"slide"},
+			Rows: []string{"region"},
+			Columns: []string{"stain"},
+			OverlayOn: "stain",
+			Overlays: []*OverlayDef{{Values: []string{"DAPI", "FITC"}}},
+			Collisions: c,
+		}
+		root, err := MakeLayout(images, l, &OverlayOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return root.AllCharts()[0], nil
+	}
+	if _, err := layout("fail"); err == nil {
+		t.Fatal("expected the fail policy to fail")
+	}
+	if overlays, _ := filepath.Glob(filepath.Join(dir, "overlay*")); len(overlays) != 0 {
+		t.Fatal("expected the fail policy to fail before making overlays", overlays)
+	}
+	chart, err := layout("first:capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := chart.Rows()[0].Images()
+	if len(row) != 3 {
+		t.Fatal("expected the first capture, FITC and their overlay", row)
+	}
+	overlay := filepath.Base(row[2].Path)
+	if !strings.Contains(overlay, "L1 DAPI 1") || strings.Contains(overlay, "L1 DAPI 2") {
+		t.Fatal("expected an overlay of the kept capture only got", overlay)
+	}
+}
@@ -0,0 +1,108 @@
+package charts
+
+import (
+	"image"
+	"io"
+	"os"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+	"github.com/timtadh/wide-view-microscopy/measure"
+)
+
+
+// Colocalize computes the colocalization of each pair of the overlaid images
+// from their original data. offsets are where each image was placed in the
+// overlay, which is previewSize. They are scaled to the size of the original
+// data (which is larger than the preview for downsampled images).
+func Colocalize(images []*ingest.Image, previewSize image.Point, offsets []image.Point, opts *OverlayOptions) ([]*measure.Coloc, error) {
+	origs := make([]image.Image, 0, len(images))
+	for _, img := range images {
+		orig, err := measure.Load(img, opts.Correction)
+		if err != nil {
+			return nil, err
+		}
+		origs = append(origs, orig)
+	}
+	origs, err := opts.Sizes.MatchSizes(images, origs)
+	if err != nil {
+		return nil, err
+	}
+	scaleX := float64(origs[0].Bounds().Dx()) / float64(previewSize.X)
+	scaleY := float64(origs[0].Bounds().Dy()) / float64(previewSize.Y)
+	scaled := make([]image.Point, 0, len(offsets))
+	for _, at := range offsets {
+		scaled = append(scaled, image.Pt(int(float64(at.X)*scaleX), int(float64(at.Y)*scaleY)))
+	}
+	common := CommonMeta(images)
+	colocs := make([]*measure.Coloc, 0, len(images)*(len(images) - 1)/2)
+	for i := 0; i < len(images); i++ {
+		for j := i + 1; j < len(images); j++ {
+			c, err := measure.Colocalize(origs[i], origs[j], scaled[j].Sub(scaled[i]))
+			if err != nil {
+				return nil, err
+			}
+			c.A, c.B = OverlayLabel(images[i], common), OverlayLabel(images[j], common)
+			colocs = append(colocs, c)
+		}
+	}
+	return colocs, nil
+}
+
+// ColocNote summarizes the coefficients for display under the overlay.
+func ColocNote(colocs []*measure.Coloc) string {
+	notes := make([]string, 0, len(colocs))
+	for _, c := range colocs {
+		notes = append(notes, c.String())
+	}
+	return strings.Join(notes, "; ")
+}
+
+// ReadColocalization reads the coefficients computed for an overlay.
+func ReadColocalization(overlay *ingest.Image) ([]*measure.Coloc, error) {
+	f, err := os.Open(overlay.Path + ".colocalization")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return measure.ReadColocs(f)
+}
+
+func writeColocs(path string, colocs []*measure.Coloc) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = measure.WriteColocs(f, colocs)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// WriteColocalizationCSV writes a row for each pair of channels of each
+// overlay in the charts (see measure.WriteCSV).
+func WriteColocalizationCSV(w io.Writer, charts []*Chart) error {
+	var images []*ingest.Image
+	var values [][]string
+	for _, chart := range charts {
+		for _, img := range chart.Images() {
+			if img.Note("colocalization") == "" {
+				continue
+			}
+			colocs, err := ReadColocalization(img)
+			if err != nil {
+				return err
+			}
+			for _, c := range colocs {
+				images = append(images, img)
+				values = append(values, c.Values())
+			}
+		}
+	}
+	return measure.WriteCSV(w, images, measure.ColocColumns(), values)
+}
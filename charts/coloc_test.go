@@ -0,0 +1,76 @@
+package charts
+
+import "testing"
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+func TestOverlayColocalization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scene := speckles(120, 90, 80, image.Pt(0, 0))
+	var images []*ingest.Image
+	for _, stain := range []string{"FITC", "TRITC"} {
+		// the originals are pngs so the data is the same in both channels
+		path := filepath.Join(dir, "1 " + stain + ".png")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = png.Encode(f, scene)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, &ingest.Image{
+			Path: path,
+			Source: path,
+			Metadata: ingest.Metadata{"region": "1", "stain": stain},
+		})
+	}
+	opts := &OverlayOptions{Colocalize: true}
+	for i := 0; i < 2; i++ {
+		// the second time the coefficients are read back from the overlay's notes
+		overlay, err := Overlay(images, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		note := overlay.Note("colocalization")
+		if !strings.HasPrefix(note, "FITC/TRITC r=1.00 M1=1.00 M2=1.00") {
+			t.Fatal("unexpected colocalization note", note)
+		}
+	}
+	charts, err := MakeCharts(images, []string{"region"}, []string{"region"}, []string{"stain"}, []string{"FITC", "TRITC"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = WriteColocalizationCSV(buf, charts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("expected a header and one pair got", lines)
+	}
+	if !strings.HasPrefix(lines[0], "region,source,page,channel_a,channel_b,pearson,") {
+		t.Fatal("unexpected header", lines[0])
+	}
+	if !strings.Contains(lines[1], ",FITC,TRITC,1,") {
+		t.Fatal("unexpected row", lines[1])
+	}
+}
@@ -0,0 +1,79 @@
+package charts
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+// ImageError is a failure to make an image of a chart, eg. an overlay of a
+// file which can not be read. The chart has an error placeholder (see
+// IsError) in its place.
+type ImageError struct {
+	Images []*ingest.Image
+	Err error
+}
+
+func (e *ImageError) Error() string {
+	paths := make([]string, 0, len(e.Images))
+	for _, img := range e.Images {
+		paths = append(paths, filepath.Base(img.Path))
+	}
+	return fmt.Sprintf("could not make an image of %v because %v", strings.Join(paths, ", "), e.Err)
+}
+
+// Errors are the images which could not be made. The charts are still made
+// without them.
+type Errors []*ImageError
+
+func (e Errors) Error() string {
+	lines := make([]string, 0, len(e) + 1)
+	lines = append(lines, fmt.Sprintf("%d chart images could not be made", len(e)))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// err is nil when there are no errors so a nil Errors is not returned as a
+// non-nil error.
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// chartErrors are the errors of the charts.
+func chartErrors(charts []*Chart) error {
+	var errs Errors
+	for _, c := range charts {
+		errs = append(errs, c.errors...)
+	}
+	return errs.err()
+}
+
+// errorImage is the placeholder for an image which could not be made.
+func errorImage(meta ingest.Metadata, err error) *ingest.Image {
+	m := make(ingest.Metadata, len(meta) + 1)
+	for k, v := range meta {
+		m[k] = v
+	}
+	m["error"] = err.Error()
+	return &ingest.Image{Metadata: m}
+}
+
+// IsError is true for the placeholders of the images which could not be made.
+func IsError(img *ingest.Image) bool {
+	return img.Path == "" && img.Meta()["error"] != ""
+}
+
+// Errors are the images of the chart which could not be made.
+func (c *Chart) Errors() []*ImageError {
+	return c.errors
+}
@@ -0,0 +1,234 @@
+package charts
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+// Column is a column of a chart: the images of each row with the same values
+// for the column sort variables.
+type Column struct {
+	meta ingest.Metadata
+	// when a row has several images with the same values they each get a
+	// column, n counts them.
+	n int
+}
+
+func (c *Column) Meta() ingest.Metadata {
+	return c.meta
+}
+
+func (c *Column) key() string {
+	return fmt.Sprintf("%v#%d", metaKey(c.meta), c.n)
+}
+
+// metaKey is a string which is the same for equal metadata.
+func metaKey(meta ingest.Metadata) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k + "=" + meta[k])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// rowColumns are the columns of the images of a row, in order.
+func rowColumns(images []*ingest.Image, sortOn []string) []*Column {
+	seen := make(map[string]int, len(images))
+	cols := make([]*Column, 0, len(images))
+	for _, img := range images {
+		meta := Submeta(img.Meta(), sortOn)
+		k := metaKey(meta)
+		cols = append(cols, &Column{meta: meta, n: seen[k]})
+		seen[k]++
+	}
+	return cols
+}
+
+// alignRows lines the images of the rows up into the same columns. Each
+// column which is missing from a row gets a placeholder image (see
+// IsMissing). The columns keep the order of the rows: a column only found in
+// some rows is placed after the column it follows in the first of them, and
+// before the next column which comes after it in that row or sorts after it.
+func alignRows(rows []*Row, sortOn []string, orders Orders) []*Column {
+	var columns []*Column
+	index := func(key string) int {
+		for i, c := range columns {
+			if c.key() == key {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, row := range rows {
+		cols := rowColumns(row.images, sortOn)
+		// the columns which come later in this row
+		later := make(map[string]bool, len(cols))
+		for _, c := range cols {
+			later[c.key()] = true
+		}
+		at := 0
+		for _, c := range cols {
+			delete(later, c.key())
+			if i := index(c.key()); i >= 0 {
+				at = i + 1
+				continue
+			}
+			for at < len(columns) && !later[columns[at].key()] && (len(sortOn) == 0 || !lessMeta(c.meta, columns[at].meta, sortOn, orders)) {
+				at++
+			}
+			columns = append(columns, nil)
+			copy(columns[at+1:], columns[at:])
+			columns[at] = c
+			at++
+		}
+	}
+	for _, row := range rows {
+		cells := make(map[string]*ingest.Image, len(row.images))
+		for i, c := range rowColumns(row.images, sortOn) {
+			cells[c.key()] = row.images[i]
+		}
+		aligned := make([]*ingest.Image, 0, len(columns))
+		for _, c := range columns {
+			if img, has := cells[c.key()]; has {
+				aligned = append(aligned, img)
+			} else {
+				aligned = append(aligned, missingImage(row, c.meta))
+			}
+		}
+		row.images = aligned
+	}
+	return columns
+}
+
+// Headers are the labels of the columns, a row of them for each of the
+// column variables. A label is left blank when it is the same as the one to
+// its left (and so are the labels above it), so the upper rows name groups
+// of columns.
+func (c *Chart) Headers() [][]string {
+	headers := make([][]string, 0, len(c.columnOn))
+	for i, key := range c.columnOn {
+		labels := make([]string, 0, len(c.columns))
+		for j, col := range c.columns {
+			if j > 0 && i < len(c.columnOn) - 1 && sameValues(col.meta, c.columns[j-1].meta, c.columnOn[:i+1]) {
+				labels = append(labels, "")
+			} else {
+				labels = append(labels, col.meta[key])
+			}
+		}
+		headers = append(headers, labels)
+	}
+	return headers
+}
+
+// RowLabels are the names of the rows, a label for each of the row variables.
+// Like the headers, a label is left blank when it is the same as the one
+// above it (and so are the labels to its left).
+func (c *Chart) RowLabels() [][]string {
+	labels := make([][]string, 0, len(c.rows))
+	for i, row := range c.rows {
+		if len(c.rowOn) == 0 {
+			labels = append(labels, []string{""})
+			continue
+		}
+		names := make([]string, 0, len(c.rowOn))
+		for j, key := range c.rowOn {
+			if i > 0 && j < len(c.rowOn) - 1 && len(row.headings) == 0 && sameValues(row.meta, c.rows[i-1].meta, c.rowOn[:j+1]) {
+				names = append(names, "")
+			} else {
+				names = append(names, row.meta[key])
+			}
+		}
+		labels = append(labels, names)
+	}
+	return labels
+}
+
+// Corner are the cells above the row labels, left of the column headers.
+func (c *Chart) Corner() []string {
+	if len(c.rowOn) <= 1 {
+		return nil
+	}
+	return make([]string, len(c.rowOn) - 1)
+}
+
+func sameValues(a, b ingest.Metadata, keys []string) bool {
+	for _, k := range keys {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// missingImage is the placeholder for the cell of a row and column which has
+// no image.
+func missingImage(row *Row, col ingest.Metadata) *ingest.Image {
+	meta := make(ingest.Metadata, len(row.meta) + len(col) + 1)
+	metas := append([]ingest.Metadata{}, row.groups...)
+	for _, m := range append(metas, row.meta, col) {
+		for k, v := range m {
+			meta[k] = v
+		}
+	}
+	meta["missing"] = "missing"
+	return &ingest.Image{Metadata: meta}
+}
+
+// IsMissing is true for the placeholders of the cells with no image.
+func IsMissing(img *ingest.Image) bool {
+	return img.Path == "" && !IsError(img)
+}
+
+// isPlaceholder is true for the images which are not files (see IsMissing and
+// IsError).
+func isPlaceholder(img *ingest.Image) bool {
+	return img.Path == ""
+}
+
+// Missing is the metadata of each cell of the chart with no image.
+func (c *Chart) Missing() []ingest.Metadata {
+	var missing []ingest.Metadata
+	for _, row := range c.rows {
+		for _, img := range row.images {
+			if IsMissing(img) {
+				meta := make(ingest.Metadata, len(img.Meta()))
+				for k, v := range img.Meta() {
+					if k != "missing" {
+						meta[k] = v
+					}
+				}
+				missing = append(missing, meta)
+			}
+		}
+	}
+	return missing
+}
+
+// MissingSummary lists the missing cells of the charts, one line per chart
+// with any.
+func MissingSummary(charts []*Chart) string {
+	var lines []string
+	for _, chart := range charts {
+		missing := chart.Missing()
+		if len(missing) == 0 {
+			continue
+		}
+		cells := make([]string, 0, len(missing))
+		for _, m := range missing {
+			cells = append(cells, fmt.Sprint(m))
+		}
+		lines = append(lines, fmt.Sprintf("chart %v is missing %d images: %v", chart.Meta(), len(missing), strings.Join(cells, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -2,7 +2,6 @@ package charts
 
 import (
 	"sort"
-	"log"
 )
 
 import (
@@ -12,11 +11,25 @@ import (
 type Chart struct {
 	meta ingest.Metadata
 	rows []*Row
+	// the rows and columns are the distinct values of the rowOn and
+	// columnOn variables.
+	rowOn []string
+	columnOn []string
+	columns []*Column
+	collisions []*Collision
+	errors []*ImageError
 }
 
 type Row struct {
 	meta ingest.Metadata
 	images []*ingest.Image
+	// the groups of rows the row is in (see Layout.RowGroups), outermost
+	// first, and the ones which start at this row.
+	groups []ingest.Metadata
+	headings []ingest.Metadata
+	// the images stacked in a cell (see StackCollisions), by the image
+	// shown in the cell.
+	stacks map[*ingest.Image][]*ingest.Image
 }
 
 type Images interface {
@@ -28,10 +41,14 @@ type Grouped interface {
 	Subgroups() []Images
 }
 
+// Submeta is the part of meta with the keys. Keys meta does not have (eg. the
+// variable an overlay was made across) are left out.
 func Submeta(meta ingest.Metadata, keys []string) ingest.Metadata {
 	sub := make(ingest.Metadata, len(keys))
 	for _, key := range keys {
-		sub[key] = meta[key]
+		if v, has := meta[key]; has {
+			sub[key] = v
+		}
 	}
 	return sub
 }
@@ -43,9 +60,10 @@ type Sortable interface {
 type sortableImages struct {
 	Images []Images
 	On []string
+	Orders Orders
 }
 
-func OrderBy(images []Images, on []string) []Images {
+func OrderBy(images []Images, on []string, orders Orders) []Images {
 	list := make([]Images, len(images))
 	copy(list, images)
 	if len(on) <= 0 {
@@ -54,8 +72,9 @@ func OrderBy(images []Images, on []string) []Images {
 	s := &sortableImages{
 		Images: list,
 		On: on,
+		Orders: orders,
 	}
-	sort.Sort(s)
+	sort.Stable(s)
 	return list
 }
 
@@ -68,21 +87,27 @@ func (s *sortableImages) Swap(i, j int) {
 }
 
 func (s *sortableImages) Less(i, j int) bool {
-	a := s.Images[i].Meta()
-	b := s.Images[j].Meta()
-	for i := 0; i < len(s.On) - 1; i++ {
-		key := s.On[i]
-		if a[key] < b[key] {
-			return true
-		} else if a[key] > b[key] {
-			return false
+	return lessMeta(s.Images[i].Meta(), s.Images[j].Meta(), s.On, s.Orders)
+}
+
+// lessMeta orders metadata on the keys in turn (see Orders). Metadata without
+// a key comes after the metadata with it, so overlays go after the images
+// they are made from.
+func lessMeta(a, b ingest.Metadata, on []string, orders Orders) bool {
+	for _, key := range on {
+		va, hasA := a[key]
+		vb, hasB := b[key]
+		if hasA != hasB {
+			return hasA
+		}
+		if c := orders[key].Compare(va, vb); c != 0 {
+			return c < 0
 		}
 	}
-	key := s.On[len(s.On)-1]
-	return a[key] < b[key]
+	return false
 }
 
-func Group(images []Images, on []string) ([][]Images, []ingest.Metadata) {
+func Group(images []Images, on []string, orders Orders) ([][]Images, []ingest.Metadata) {
 	if len(images) <= 0 {
 		return nil, nil
 	}
@@ -95,7 +120,7 @@ func Group(images []Images, on []string) ([][]Images, []ingest.Metadata) {
 		}
 		return groups, metas
 	}
-	images = OrderBy(images, on)
+	images = OrderBy(images, on, orders)
 	cur := Submeta(images[0].Meta(), on)
 	group := make([]Images, 0, 10)
 	for _, img := range images {
@@ -113,7 +138,10 @@ func Group(images []Images, on []string) ([][]Images, []ingest.Metadata) {
 	return groups, metas
 }
 
-func OverlayImages(imgs []*ingest.Image, key string, vals []string) []*ingest.Image {
+// overlayValues overlays the images whose value for key is one of vals. It is
+// nil when there are fewer than two of them or their sizes do not match (see
+// SizePolicy). Other failures give an error placeholder and an *ImageError.
+func overlayValues(imgs []*ingest.Image, key string, vals []string, opts *OverlayOptions) (*ingest.Image, *ImageError) {
 	in := func(val string, vals []string) bool {
 		for _, v2 := range vals {
 			if val == v2 {
@@ -123,7 +151,7 @@ func OverlayImages(imgs []*ingest.Image, key string, vals []string) []*ingest.Im
 		return false
 	}
 	if len(vals) <= 1 {
-		return imgs
+		return nil, nil
 	}
 	toOverlay := make([]*ingest.Image, 0, len(imgs))
 	for _, img := range imgs {
@@ -131,34 +159,75 @@ func OverlayImages(imgs []*ingest.Image, key string, vals []string) []*ingest.Im
 			toOverlay = append(toOverlay, img)
 		}
 	}
-	overlayed, err := Overlay(toOverlay)
+	if len(toOverlay) <= 1 {
+		return nil, nil
+	}
+	overlayed, err := Overlay(toOverlay, opts)
 	if err != nil {
-		log.Panic(err)
+		return errorImage(CommonMeta(toOverlay), err), &ImageError{Images: toOverlay, Err: err}
 	}
-	return append(imgs, overlayed)
+	return overlayed, nil
 }
 
-func MakeRows(images []*ingest.Image, on, sortOn, overlay []string) []*Row {
-	groups, metas := Group(imageListAsImages(images), on)
+// MakeRows groups the images into rows on on, sorted on sortOn, and appends
+// the overlay of the overlay values of sortOn[0] to each row. The rows are
+// made even when some overlays fail, the error is then an Errors.
+func MakeRows(images []*ingest.Image, on, sortOn, overlay []string, opts *OverlayOptions) ([]*Row, error) {
+	rows := groupRows(images, on, sortOn, nil)
+	if len(sortOn) == 0 {
+		return rows, nil
+	}
+	var errs Errors
+	for _, row := range rows {
+		overlaid, err := overlayValues(row.images, sortOn[0], overlay, opts)
+		if overlaid != nil {
+			row.images = append(row.images, overlaid)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return rows, errs.err()
+}
+
+func groupRows(images []*ingest.Image, on, sortOn []string, orders Orders) []*Row {
+	groups, metas := Group(imageListAsImages(images), on, orders)
 	rows := make([]*Row, 0, len(groups))
 	for i := 0; i < len(groups); i++ {
-		row := imagesAsImageList(OrderBy(groups[i], sortOn))
-		if len(sortOn) > 0 {
-			row = OverlayImages(row, sortOn[0], overlay)
-		}
+		row := imagesAsImageList(OrderBy(groups[i], sortOn, orders))
 		rows = append(rows, &Row{meta: metas[i], images: row})
 	}
 	return rows
 }
 
-func MakeCharts(images []*ingest.Image, on, rowOn, sortOn, overlay []string) []*Chart {
-	groups, metas := Group(imageListAsImages(images), on)
-	charts := make([]*Chart, 0, len(groups))
-	for i := 0; i < len(groups); i++ {
-		rows := MakeRows(imagesAsImageList(groups[i]), rowOn, sortOn, overlay)
-		charts = append(charts, &Chart{meta: metas[i], rows: rows})
+// MakeCharts groups the images into charts on on (see MakeRows). The values
+// are sorted alphabetically, use a Layout with Orders to sort them otherwise.
+// The charts are made even when some overlays fail, the error is then an
+// Errors.
+func MakeCharts(images []*ingest.Image, on, rowOn, sortOn, overlay []string, opts *OverlayOptions) ([]*Chart, error) {
+	l := &Layout{Charts: on, Rows: rowOn, Columns: sortOn, Overlays: []*OverlayDef{{Values: overlay}}}
+	if len(sortOn) > 0 {
+		l.OverlayOn = sortOn[0]
+	}
+	charts, err := makeCharts(images, l, opts)
+	if err != nil {
+		return nil, err
+	}
+	return charts, chartErrors(charts)
+}
+
+// QuarantineChart holds the images which failed the quality checks (see
+// measure.QualityCheck), in the rows and columns of l, so they can be
+// reviewed apart from the other charts.
+func QuarantineChart(images []*ingest.Image, l *Layout) *Chart {
+	rows := groupRows(images, l.Rows, l.Columns, l.Orders)
+	return &Chart{
+		meta: ingest.Metadata{"quarantine": "failed the quality checks"},
+		rows: rows,
+		rowOn: l.Rows,
+		columnOn: l.Columns,
+		columns: alignRows(rows, l.Columns, l.Orders),
 	}
-	return charts
 }
 
 func imagesAsImageList(images []Images) []*ingest.Image {
@@ -216,6 +285,25 @@ func (c *Chart) Rows() []*Row {
 	return c.rows
 }
 
+func (c *Chart) Columns() []*Column {
+	return c.columns
+}
+
+// Collisions are the cells of the chart which had more than one image.
+func (c *Chart) Collisions() []*Collision {
+	return c.collisions
+}
+
+// RowOn are the variables the rows of the chart are grouped on.
+func (c *Chart) RowOn() []string {
+	return c.rowOn
+}
+
+// ColumnOn are the variables the columns of the chart are sorted on.
+func (c *Chart) ColumnOn() []string {
+	return c.columnOn
+}
+
 func (c *Chart) Subgroups() []Images {
 	return rowsAsImages(c.rows)
 }
@@ -228,6 +316,18 @@ func (r *Row) Images() []*ingest.Image {
 	return r.images
 }
 
+// Stack are the images in the cell of img when several images were stacked in
+// it (see StackCollisions), otherwise nil.
+func (r *Row) Stack(img *ingest.Image) []*ingest.Image {
+	return r.stacks[img]
+}
+
+// Headings are the groups of rows (see Layout.RowGroups) which start at this
+// row, outermost first.
+func (r *Row) Headings() []ingest.Metadata {
+	return r.headings
+}
+
 func (r *Row) Subgroups() []Images {
 	return imageListAsImages(r.images)
 }
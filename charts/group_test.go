@@ -2,6 +2,14 @@ package charts
 
 import "testing"
 
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
 import (
 	"github.com/timtadh/wide-view-microscopy/ingest"
 )
@@ -18,17 +26,20 @@ func TestGroup(t *testing.T) {
 		t.Fatal(err)
 	}
 	images := []*ingest.Image{
-		{"path/a", eatError(format.Parse([]byte("slide-1 sample-1 L1 FFa.tif")))},
-		{"path/b", eatError(format.Parse([]byte("slide-2 sample-1 L2 FFa.tif")))},
-		{"path/c", eatError(format.Parse([]byte("slide-1 sample-1 L3 FFa.tif")))},
-		{"path/d", eatError(format.Parse([]byte("slide-2 sample-1 L1 FFb.tif")))},
-		{"path/e", eatError(format.Parse([]byte("slide-1 sample-1 L2 FFb.tif")))},
-		{"path/f", eatError(format.Parse([]byte("slide-2 sample-1 L3 FFb.tif")))},
-		{"path/g", eatError(format.Parse([]byte("slide-1 sample-1 L1 FFc.tif")))},
-		{"path/h", eatError(format.Parse([]byte("slide-2 sample-1 L2 FFc.tif")))},
-		{"path/i", eatError(format.Parse([]byte("slide-1 sample-1 L3 FFc.tif")))},
-	}
-	rows := MakeRows(images, []string{"slide", "region"}, []string{})
+		{Path: "path/a", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L1 FFa.tif")))},
+		{Path: "path/b", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L2 FFa.tif")))},
+		{Path: "path/c", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L3 FFa.tif")))},
+		{Path: "path/d", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L1 FFb.tif")))},
+		{Path: "path/e", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L2 FFb.tif")))},
+		{Path: "path/f", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L3 FFb.tif")))},
+		{Path: "path/g", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L1 FFc.tif")))},
+		{Path: "path/h", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L2 FFc.tif")))},
+		{Path: "path/i", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L3 FFc.tif")))},
+	}
+	rows, err := MakeRows(images, []string{"slide", "region"}, []string{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, row := range rows {
 		t.Log("row", row.Meta())
 		for _, img := range row.Images() {
@@ -68,44 +79,47 @@ func TestMakeCharts(t *testing.T) {
 		t.Fatal(err)
 	}
 	images := []*ingest.Image{
-		{"path/a-1", eatError(format.Parse([]byte("slide-1 sample-1 L1 FFa.tif")))},
-		{"path/b-1", eatError(format.Parse([]byte("slide-1 sample-1 L2 FFa.tif")))},
-		{"path/c-1", eatError(format.Parse([]byte("slide-1 sample-1 L3 FFa.tif")))},
-		{"path/d-1", eatError(format.Parse([]byte("slide-1 sample-1 L1 FFb.tif")))},
-		{"path/e-1", eatError(format.Parse([]byte("slide-1 sample-1 L2 FFb.tif")))},
-		{"path/f-1", eatError(format.Parse([]byte("slide-1 sample-1 L3 FFb.tif")))},
-		{"path/g-1", eatError(format.Parse([]byte("slide-1 sample-1 L1 FFc.tif")))},
-		{"path/h-1", eatError(format.Parse([]byte("slide-1 sample-1 L2 FFc.tif")))},
-		{"path/i-1", eatError(format.Parse([]byte("slide-1 sample-1 L3 FFc.tif")))},
-		{"path/a-2", eatError(format.Parse([]byte("slide-2 sample-1 L1 FFa.tif")))},
-		{"path/b-2", eatError(format.Parse([]byte("slide-2 sample-1 L2 FFa.tif")))},
-		{"path/c-2", eatError(format.Parse([]byte("slide-2 sample-1 L3 FFa.tif")))},
-		{"path/d-2", eatError(format.Parse([]byte("slide-2 sample-1 L1 FFb.tif")))},
-		{"path/e-2", eatError(format.Parse([]byte("slide-2 sample-1 L2 FFb.tif")))},
-		{"path/f-2", eatError(format.Parse([]byte("slide-2 sample-1 L3 FFb.tif")))},
-		{"path/g-2", eatError(format.Parse([]byte("slide-2 sample-1 L1 FFc.tif")))},
-		{"path/h-2", eatError(format.Parse([]byte("slide-2 sample-1 L2 FFc.tif")))},
-		{"path/i-2", eatError(format.Parse([]byte("slide-2 sample-1 L3 FFc.tif")))},
-		{"path/a-3", eatError(format.Parse([]byte("slide-1 sample-2 L1 FFa.tif")))},
-		{"path/b-3", eatError(format.Parse([]byte("slide-1 sample-2 L2 FFa.tif")))},
-		{"path/c-3", eatError(format.Parse([]byte("slide-1 sample-2 L3 FFa.tif")))},
-		{"path/d-3", eatError(format.Parse([]byte("slide-1 sample-2 L1 FFb.tif")))},
-		{"path/e-3", eatError(format.Parse([]byte("slide-1 sample-2 L2 FFb.tif")))},
-		{"path/f-3", eatError(format.Parse([]byte("slide-1 sample-2 L3 FFb.tif")))},
-		{"path/g-3", eatError(format.Parse([]byte("slide-1 sample-2 L1 FFc.tif")))},
-		{"path/h-3", eatError(format.Parse([]byte("slide-1 sample-2 L2 FFc.tif")))},
-		{"path/i-3", eatError(format.Parse([]byte("slide-1 sample-2 L3 FFc.tif")))},
-		{"path/a-4", eatError(format.Parse([]byte("slide-2 sample-2 L1 FFa.tif")))},
-		{"path/b-4", eatError(format.Parse([]byte("slide-2 sample-2 L2 FFa.tif")))},
-		{"path/c-4", eatError(format.Parse([]byte("slide-2 sample-2 L3 FFa.tif")))},
-		{"path/d-4", eatError(format.Parse([]byte("slide-2 sample-2 L1 FFb.tif")))},
-		{"path/e-4", eatError(format.Parse([]byte("slide-2 sample-2 L2 FFb.tif")))},
-		{"path/f-4", eatError(format.Parse([]byte("slide-2 sample-2 L3 FFb.tif")))},
-		{"path/g-4", eatError(format.Parse([]byte("slide-2 sample-2 L1 FFc.tif")))},
-		{"path/h-4", eatError(format.Parse([]byte("slide-2 sample-2 L2 FFc.tif")))},
-		{"path/i-4", eatError(format.Parse([]byte("slide-2 sample-2 L3 FFc.tif")))},
-	}
-	charts := MakeCharts(images, []string{"sample", "slide"}, []string{"region"}, []string{"stain"})
+		{Path: "path/a-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L1 FFa.tif")))},
+		{Path: "path/b-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L2 FFa.tif")))},
+		{Path: "path/c-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L3 FFa.tif")))},
+		{Path: "path/d-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L1 FFb.tif")))},
+		{Path: "path/e-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L2 FFb.tif")))},
+		{Path: "path/f-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L3 FFb.tif")))},
+		{Path: "path/g-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L1 FFc.tif")))},
+		{Path: "path/h-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L2 FFc.tif")))},
+		{Path: "path/i-1", Metadata: eatError(format.Parse([]byte("slide-1 sample-1 L3 FFc.tif")))},
+		{Path: "path/a-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L1 FFa.tif")))},
+		{Path: "path/b-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L2 FFa.tif")))},
+		{Path: "path/c-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L3 FFa.tif")))},
+		{Path: "path/d-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L1 FFb.tif")))},
+		{Path: "path/e-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L2 FFb.tif")))},
+		{Path: "path/f-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L3 FFb.tif")))},
+		{Path: "path/g-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L1 FFc.tif")))},
+		{Path: "path/h-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L2 FFc.tif")))},
+		{Path: "path/i-2", Metadata: eatError(format.Parse([]byte("slide-2 sample-1 L3 FFc.tif")))},
+		{Path: "path/a-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L1 FFa.tif")))},
+		{Path: "path/b-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L2 FFa.tif")))},
+		{Path: "path/c-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L3 FFa.tif")))},
+		{Path: "path/d-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L1 FFb.tif")))},
+		{Path: "path/e-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L2 FFb.tif")))},
+		{Path: "path/f-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L3 FFb.tif")))},
+		{Path: "path/g-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L1 FFc.tif")))},
+		{Path: "path/h-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L2 FFc.tif")))},
+		{Path: "path/i-3", Metadata: eatError(format.Parse([]byte("slide-1 sample-2 L3 FFc.tif")))},
+		{Path: "path/a-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L1 FFa.tif")))},
+		{Path: "path/b-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L2 FFa.tif")))},
+		{Path: "path/c-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L3 FFa.tif")))},
+		{Path: "path/d-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L1 FFb.tif")))},
+		{Path: "path/e-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L2 FFb.tif")))},
+		{Path: "path/f-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L3 FFb.tif")))},
+		{Path: "path/g-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L1 FFc.tif")))},
+		{Path: "path/h-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L2 FFc.tif")))},
+		{Path: "path/i-4", Metadata: eatError(format.Parse([]byte("slide-2 sample-2 L3 FFc.tif")))},
+	}
+	charts, err := MakeCharts(images, []string{"sample", "slide"}, []string{"region"}, []string{"stain"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, chart := range charts {
 		t.Log("chart", chart.Meta())
 		for _, row := range chart.rows {
@@ -118,3 +132,169 @@ func TestMakeCharts(t *testing.T) {
 		t.Log()
 	}
 }
+
+func TestMakeChartsMissing(t *testing.T) {
+	images := []*ingest.Image{
+		{Path: "path/a", Metadata: ingest.Metadata{"region": "L1", "stain": "DAPI"}},
+		{Path: "path/b", Metadata: ingest.Metadata{"region": "L1", "stain": "FITC"}},
+		{Path: "path/c", Metadata: ingest.Metadata{"region": "L1", "stain": "TRITC"}},
+		{Path: "path/d", Metadata: ingest.Metadata{"region": "L2", "stain": "DAPI"}},
+		{Path: "path/e", Metadata: ingest.Metadata{"region": "L2", "stain": "TRITC"}},
+		{Path: "path/f", Metadata: ingest.Metadata{"region": "L3", "stain": "FITC"}},
+	}
+	for _, img := range images {
+		img.Metadata["slide"] = "slide-1"
+	}
+	charts, err := MakeCharts(images, []string{"slide"}, []string{"region"}, []string{"stain"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chart := charts[0]
+	stains := []string{"DAPI", "FITC", "TRITC"}
+	if len(chart.Columns()) != len(stains) {
+		t.Fatal("expected a column per stain", chart.Columns())
+	}
+	for i, col := range chart.Columns() {
+		if col.Meta()["stain"] != stains[i] {
+			t.Fatal("wrong column", i, col.Meta(), stains[i])
+		}
+	}
+	paths := [][]string{
+		{"path/a", "path/b", "path/c"},
+		{"path/d", "", "path/e"},
+		{"", "path/f", ""},
+	}
+	for i, row := range chart.Rows() {
+		for j, img := range row.Images() {
+			if img.Path != paths[i][j] {
+				t.Fatal("wrong cell", i, j, img, paths[i][j])
+			}
+			if IsMissing(img) && (img.Meta()["stain"] != stains[j] || img.Meta()["region"] != row.Meta()["region"]) {
+				t.Fatal("wrong placeholder", i, j, img.Meta())
+			}
+		}
+	}
+	if missing := chart.Missing(); len(missing) != 3 {
+		t.Fatal("expected 3 missing cells", missing)
+	}
+}
+
+func TestAlignRowsSortsNewColumns(t *testing.T) {
+	images := []*ingest.Image{
+		{Path: "path/a", Metadata: ingest.Metadata{"region": "L1", "stain": "FITC"}},
+		{Path: "path/b", Metadata: ingest.Metadata{"region": "L2", "stain": "DAPI"}},
+		{Path: "path/c", Metadata: ingest.Metadata{"region": "L2", "stain": "FITC"}},
+		{Path: "path/d", Metadata: ingest.Metadata{"region": "L3", "stain": "TRITC"}},
+	}
+	charts, err := MakeCharts(images, []string{"missing"}, []string{"region"}, []string{"stain"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chart := charts[0]
+	stains := []string{"DAPI", "FITC", "TRITC"}
+	if len(chart.Columns()) != len(stains) {
+		t.Fatal("expected a column per stain", chart.Columns())
+	}
+	for i, col := range chart.Columns() {
+		if col.Meta()["stain"] != stains[i] {
+			t.Fatal("wrong column", i, col.Meta(), stains[i])
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	images := []*ingest.Image{
+		{Path: "path/a", Metadata: ingest.Metadata{"region": "L1", "z": "1", "channel": "red"}},
+		{Path: "path/b", Metadata: ingest.Metadata{"region": "L1", "z": "1", "channel": "green"}},
+		{Path: "path/c", Metadata: ingest.Metadata{"region": "L1", "z": "2", "channel": "red"}},
+		{Path: "path/d", Metadata: ingest.Metadata{"region": "L2", "z": "2", "channel": "green"}},
+	}
+	charts, err := MakeCharts(images, []string{"missing"}, []string{"region"}, []string{"z", "channel"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chart := charts[0]
+	headers := [][]string{
+		{"1", "", "2", ""},
+		{"green", "red", "green", "red"},
+	}
+	if len(chart.Headers()) != len(headers) {
+		t.Fatal("expected a header row per column variable", chart.Headers())
+	}
+	for i, labels := range chart.Headers() {
+		for j, label := range labels {
+			if label != headers[i][j] {
+				t.Fatal("wrong header", i, j, label, headers[i][j])
+			}
+		}
+	}
+}
+
+func TestMakeChartsOverlayError(t *testing.T) {
+	images := []*ingest.Image{
+		{Path: "/does/not/exist/L1 FITC.png", Metadata: ingest.Metadata{"slide": "1", "region": "L1", "stain": "FITC"}},
+		{Path: "/does/not/exist/L1 TRITC.png", Metadata: ingest.Metadata{"slide": "1", "region": "L1", "stain": "TRITC"}},
+	}
+	charts, err := MakeCharts(images, []string{"slide"}, []string{"region"}, []string{"stain"}, []string{"FITC", "TRITC"}, nil)
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 1 || len(errs[0].Images) != 2 {
+		t.Fatal("expected the overlay to fail", err)
+	}
+	if len(charts) != 1 || len(charts[0].Errors()) != 1 {
+		t.Fatal("expected the chart to be made with the error", charts)
+	}
+	row := charts[0].Rows()[0].Images()
+	if len(row) != 3 || !IsError(row[2]) || IsMissing(row[2]) {
+		t.Fatal("expected an error placeholder for the overlay", row)
+	}
+	html, err := charts[0].HTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), "could not be made") {
+		t.Fatal("expected the error placeholder in the html")
+	}
+}
+
+func TestMakeChartsSizeMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	images := make([]*ingest.Image, 0, 2)
+	for i, stain := range []string{"FITC", "TRITC"} {
+		path := filepath.Join(dir, stain + ".jpeg")
+		err := ingest.WriteJpeg(path, image.NewGray(image.Rect(0, 0, 8 + i, 8)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, &ingest.Image{
+			Path: path,
+			Metadata: ingest.Metadata{"slide": "1", "region": "L1", "stain": stain},
+		})
+	}
+	charts, err := MakeCharts(images, []string{"slide"}, []string{"region"}, []string{"stain"}, []string{"FITC", "TRITC"}, nil)
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 1 {
+		t.Fatal("expected the overlay to be refused", err)
+	}
+	if _, ok := errs[0].Err.(*SizeMismatchError); !ok {
+		t.Fatal("expected a *SizeMismatchError got", errs[0].Err)
+	}
+	row := charts[0].Rows()[0].Images()
+	if len(row) != 3 || !IsError(row[2]) {
+		t.Fatal("expected an error placeholder for the refused overlay", row)
+	}
+}
+
+func TestOverlayLabelKeepsNoteNames(t *testing.T) {
+	img := &ingest.Image{
+		Path: "a.jpeg",
+		Metadata: ingest.Metadata{"region": "L1", "focus": "near"},
+		Notes: map[string]string{"objects": "3"},
+	}
+	if label := OverlayLabel(img, ingest.Metadata{"region": "L1"}); label != "near" {
+		t.Fatal("expected the focus variable as the label got", label)
+	}
+}
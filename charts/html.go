@@ -2,7 +2,6 @@ package charts
 
 import (
 	"bytes"
-	"log"
 	"html/template"
 )
 
@@ -17,26 +16,93 @@ var CHART_TEMPLATE = template.Must(template.New("chart").Funcs(funcs).Parse(`
 </div>
 <div class="chart">
 	<div class="chart-fields">
-		<div class="chart-field"></div>
-		{{range $col := (index .Rows 0).Images}}
-			<div class="chart-field">
-				{{(index $col.Meta "stain")}}
+		{{range $i, $labels := .Headers}}
+			<div class="chart-field-row">
+				{{range $.Corner}}
+					<div class="chart-field"></div>
+				{{end}}
+				<div class="chart-field">{{index $.ColumnOn $i}}</div>
+				{{range $label := $labels}}
+					<div class="chart-field">{{$label}}</div>
+				{{end}}
 			</div>
 		{{end}}
 	</div>
-	{{range $row := .Rows}}
-		<div class="chart-row">
-			<div class="chart-row-name">
-				{{$row.Meta}}
+	{{$labels := .RowLabels}}
+	{{range $i, $row := .Rows}}
+		{{range $heading := $row.Headings}}
+			<div class="chart-row-group">
+				<div class="chart-row-group-name">{{$heading}}</div>
 			</div>
+		{{end}}
+		<div class="chart-row">
+			{{range $label := index $labels $i}}
+				<div class="chart-row-name">{{$label}}</div>
+			{{end}}
 			{{range $col := $row.Images}}
+				{{if not $col.Path}}
+				{{with (index $col.Meta "error")}}
+				<div class="chart-img chart-img-error">
+					<div class="chart-img-note" title="{{.}}">could not be made</div>
+				</div>
+				{{else}}
+				<div class="chart-img chart-img-missing">
+					<div class="chart-img-note">missing</div>
+				</div>
+				{{end}}
+				{{else}}
 				<div class="chart-img">
-					<img src="file:///{{$col.Path}}"/>
+					{{with $row.Stack $col}}
+						<div class="chart-img-stack">
+							{{range $img := .}}
+								<img src="file:///{{$img.Path}}" title="{{$img.Meta}}"/>
+							{{end}}
+						</div>
+						<div class="chart-img-note">{{len .}} images</div>
+					{{else}}
+						<img src="file:///{{$col.Path}}"/>
+					{{end}}
+					{{with ($col.Note "quality")}}
+						<div class="chart-img-badge" title="focus {{$col.Note "focus"}}, {{$col.Note "overexposed"}} overexposed">{{.}}</div>
+					{{end}}
+					{{with ($col.Note "registration")}}
+						<div class="chart-img-note">shift {{.}}</div>
+					{{end}}
+					{{with ($col.Note "colocalization")}}
+						<div class="chart-img-note">{{.}}</div>
+					{{end}}
+					{{with ($col.Note "objects")}}
+						<div class="chart-img-note">{{.}} objects</div>
+					{{end}}
 				</div>
+				{{end}}
 			{{end}}
 		</div>
 	{{end}}
 </div>
+{{with .Missing}}
+<div class="chart-missing">
+	missing {{len .}} images:
+	{{range $meta := .}}
+		<div class="chart-missing-cell">{{$meta}}</div>
+	{{end}}
+</div>
+{{end}}
+`))
+
+var SECTION_TEMPLATE = template.Must(template.New("section").Parse(`
+<div class="section">
+	{{with .Meta}}
+		<div class="section-info">{{.}}</div>
+	{{end}}
+	{{range $section := .Sections}}
+		{{$section.HTML}}
+	{{end}}
+	{{range $chart := .Charts}}
+		{{$chart.HTML}}
+		<hr/>
+	{{end}}
+</div>
 `))
 
 var CHARTS_TEMPLATE = template.Must(template.New("charts").Parse(`<!DOCTYPE html>
@@ -49,6 +115,9 @@ var CHARTS_TEMPLATE = template.Must(template.New("charts").Parse(`<!DOCTYPE html
 .chart-fields {
 	display: table-header-group;
 }
+.chart-field-row {
+	display: table-row;
+}
 .chart-field {
 	display: table-cell;
 }
@@ -59,6 +128,21 @@ var CHARTS_TEMPLATE = template.Must(template.New("charts").Parse(`<!DOCTYPE html
 	display: table-cell;
 	vertical-align: middle;
 }
+.chart-row-group {
+	display: table-row;
+}
+.chart-row-group-name {
+	display: table-cell;
+	font-weight: bold;
+	padding-top: 1em;
+}
+.section {
+	margin-left: 1em;
+}
+.section-info {
+	font-size: large;
+	font-weight: bold;
+}
 .chart-img {
 	width: 250px;
 	height: 250px;
@@ -72,6 +156,39 @@ var CHARTS_TEMPLATE = template.Must(template.New("charts").Parse(`<!DOCTYPE html
 	width: inherit;
 	height: inherit;
 }
+.chart-img-stack {
+	display: flex;
+	width: inherit;
+	height: inherit;
+	overflow-x: auto;
+	scroll-snap-type: x mandatory;
+}
+.chart-img-stack img {
+	flex: 0 0 100%;
+	scroll-snap-align: start;
+}
+.chart-img-badge {
+	font-size: small;
+	text-align: center;
+	color: white;
+	background: #c62828;
+}
+.chart-img-missing {
+	background: #eeeeee;
+	vertical-align: middle;
+}
+.chart-img-error {
+	background: #ffcdd2;
+	vertical-align: middle;
+}
+.chart-missing {
+	font-size: small;
+	color: #c62828;
+}
+.chart-img-note {
+	font-size: small;
+	text-align: center;
+}
 img.chart-overlap {
 	position: relative;
 	width: 250px;
@@ -87,26 +204,40 @@ img.chart-overlap-others {
 {{$chart.HTML}}
 <hr/>
 {{end}}
+{{range $section := .sections}}
+{{$section.HTML}}
+{{end}}
 </body>
 </html>
 `))
 
-func ChartsHTML(charts []*Chart) template.HTML {
+func ChartsHTML(charts []*Chart) (template.HTML, error) {
 	return html(CHARTS_TEMPLATE, map[string]interface{}{
 		"charts": charts,
 	})
 }
 
-func (c *Chart) HTML() template.HTML {
+// LayoutHTML renders the charts of a layout (see MakeLayout) in their
+// sections.
+func LayoutHTML(root *Section) (template.HTML, error) {
+	return html(CHARTS_TEMPLATE, map[string]interface{}{
+		"sections": []*Section{root},
+	})
+}
+
+func (s *Section) HTML() (template.HTML, error) {
+	return html(SECTION_TEMPLATE, s)
+}
+
+func (c *Chart) HTML() (template.HTML, error) {
 	return html(CHART_TEMPLATE, c)
 }
 
-func html(t *template.Template, data interface{}) template.HTML {
+func html(t *template.Template, data interface{}) (template.HTML, error) {
 	buf := new(bytes.Buffer)
 	err := t.Execute(buf, data)
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
-	return template.HTML(buf.String())
+	return template.HTML(buf.String()), nil
 }
-
@@ -0,0 +1,281 @@
+package charts
+
+import (
+	"fmt"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+// Layout is the hierarchy the images are arranged in. Each level groups the
+// images with the same values for its variables, from the outermost in:
+//
+//	sections → charts → row groups → rows → columns
+//
+// eg. a section per subject, a chart per slide, a group of rows per region
+// and a row per z-slice with a column per stain. There can be any number of
+// levels of sections and row groups, including none.
+type Layout struct {
+	Sections [][]string
+	Charts []string
+	RowGroups [][]string
+	Rows []string
+	// the variables the images of a row are sorted on (see Chart.ColumnOn).
+	Columns []string
+	// the variable whose values are overlaid and the overlays to make of
+	// each cell. named overlays get their name as their value for it, so
+	// they are ordered like the other values (see Orders below). unnamed
+	// overlays do not have a value for it and are placed after the images
+	// they are made from in whichever rows or columns it is laid out on.
+	OverlayOn string
+	Overlays []*OverlayDef
+	// what to do with cells with more than one image. nil gives each of the
+	// images a column.
+	Collisions *Collisions
+	// how the values of the variables are sorted at every level.
+	Orders Orders
+}
+
+// Transpose swaps the variables of the rows and the columns, eg. to have a
+// row per stain and a column per region. Layouts with row groups can not be
+// transposed as the columns can not be grouped under headings.
+func (l *Layout) Transpose() error {
+	if len(l.RowGroups) > 0 {
+		return fmt.Errorf("can not transpose a layout with row groups %v", l.RowGroups)
+	}
+	l.Rows, l.Columns = l.Columns, l.Rows
+	return nil
+}
+
+// OverlayDef is an overlay of the images with the Values for the overlaid
+// variable, eg. merge=DAPI,FITC,TRITC.
+type OverlayDef struct {
+	Name string
+	Values []string
+}
+
+// ParseOverlayDef parses <name>=<vals>.
+func ParseOverlayDef(s string) (*OverlayDef, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return nil, fmt.Errorf("expected <name>=<vals> got '%v'", s)
+	}
+	o := &OverlayDef{Name: strings.TrimSpace(parts[0])}
+	for _, v := range strings.Split(parts[1], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			o.Values = append(o.Values, v)
+		}
+	}
+	if len(o.Values) < 2 {
+		return nil, fmt.Errorf("the overlay '%v' needs at least two values to overlay got '%v'", o.Name, parts[1])
+	}
+	return o, nil
+}
+
+// Section is a group of charts, or of the sections below it.
+type Section struct {
+	meta ingest.Metadata
+	sections []*Section
+	charts []*Chart
+}
+
+// MakeLayout arranges the images as laid out by l. The sections (if any) are
+// under the returned root section, which has no metadata of its own. It
+// fails when a cell has more than one image and the collision policy is
+// FailOnCollision. The layout is still made when some of its images (eg.
+// overlays) can not be made, the error is then an Errors.
+func MakeLayout(images []*ingest.Image, l *Layout, opts *OverlayOptions) (*Section, error) {
+	root, err := makeSection(make(ingest.Metadata), images, l, l.Sections, opts)
+	if err != nil {
+		return nil, err
+	}
+	return root, chartErrors(root.AllCharts())
+}
+
+func makeSection(meta ingest.Metadata, images []*ingest.Image, l *Layout, levels [][]string, opts *OverlayOptions) (*Section, error) {
+	s := &Section{meta: meta}
+	if len(levels) == 0 {
+		charts, err := makeCharts(images, l, opts)
+		if err != nil {
+			return nil, err
+		}
+		s.charts = charts
+		return s, nil
+	}
+	groups, metas := Group(imageListAsImages(images), levels[0], l.Orders)
+	for i := 0; i < len(groups); i++ {
+		sub, err := makeSection(metas[i], imagesAsImageList(groups[i]), l, levels[1:], opts)
+		if err != nil {
+			return nil, err
+		}
+		s.sections = append(s.sections, sub)
+	}
+	return s, nil
+}
+
+func makeCharts(images []*ingest.Image, l *Layout, opts *OverlayOptions) ([]*Chart, error) {
+	groups, metas := Group(imageListAsImages(images), l.Charts, l.Orders)
+	charts := make([]*Chart, 0, len(groups))
+	for i := 0; i < len(groups); i++ {
+		rows := makeRows(imagesAsImageList(groups[i]), l.RowGroups, l.Rows, l.Columns, l.Orders)
+		// the collisions are resolved first so the overlays are only made of
+		// the images which are kept
+		var collisions []*Collision
+		var resolved []*ingest.Image
+		stacks := make(map[*ingest.Image][]*ingest.Image)
+		for _, row := range rows {
+			c, err := l.Collisions.resolve(row, l.Columns, l.Orders)
+			if err != nil {
+				return nil, fmt.Errorf("chart %v %v", metas[i], err)
+			}
+			collisions = append(collisions, c...)
+			resolved = append(resolved, row.images...)
+			for img, stack := range row.stacks {
+				stacks[img] = stack
+			}
+		}
+		overlays, errs := overlayCells(resolved, l, opts)
+		if len(overlays) > 0 {
+			rows = makeRows(append(resolved, overlays...), l.RowGroups, l.Rows, l.Columns, l.Orders)
+			for _, row := range rows {
+				row.keepStacks(stacks)
+			}
+		}
+		columns := alignRows(rows, l.Columns, l.Orders)
+		charts = append(charts, &Chart{
+			meta: metas[i],
+			rows: rows,
+			rowOn: l.Rows,
+			columnOn: l.Columns,
+			columns: columns,
+			collisions: collisions,
+			errors: errs,
+		})
+	}
+	return charts, nil
+}
+
+// overlayCells makes the overlays (see Layout.Overlays) of each group of the
+// images which are in the same place in the layout but for their values for
+// l.OverlayOn.
+func overlayCells(images []*ingest.Image, l *Layout, opts *OverlayOptions) ([]*ingest.Image, Errors) {
+	if l.OverlayOn == "" || len(l.Overlays) == 0 || len(images) == 0 {
+		return nil, nil
+	}
+	vars := append([]string{}, l.Rows...)
+	vars = append(vars, l.Columns...)
+	for _, group := range l.RowGroups {
+		vars = append(vars, group...)
+	}
+	var on []string
+	for _, v := range vars {
+		if v != l.OverlayOn {
+			on = append(on, v)
+		}
+	}
+	groups := [][]Images{imageListAsImages(images)}
+	if len(on) > 0 {
+		groups, _ = Group(groups[0], on, l.Orders)
+	}
+	var errs Errors
+	var out []*ingest.Image
+	for _, group := range groups {
+		cell := imagesAsImageList(OrderBy(group, []string{l.OverlayOn}, l.Orders))
+		for _, def := range l.Overlays {
+			overlaid, err := overlayValues(cell, l.OverlayOn, def.Values, opts)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if overlaid == nil {
+				continue
+			}
+			if def.Name != "" {
+				overlaid.Metadata[l.OverlayOn] = def.Name
+			}
+			out = append(out, overlaid)
+		}
+	}
+	return out, errs
+}
+
+// makeRows groups the rows on all of the variables of the row groups and the
+// rows so the rows of a group are next to each other, then splits the meta of
+// each row into its groups.
+func makeRows(images []*ingest.Image, groupOn [][]string, on, sortOn []string, orders Orders) []*Row {
+	var all []string
+	for _, vars := range groupOn {
+		all = append(all, vars...)
+	}
+	rows := groupRows(images, append(all, on...), sortOn, orders)
+	if len(groupOn) == 0 {
+		return rows
+	}
+	var prev []ingest.Metadata
+	for _, row := range rows {
+		full := row.meta
+		row.meta = Submeta(full, on)
+		row.groups = make([]ingest.Metadata, 0, len(groupOn))
+		for _, vars := range groupOn {
+			row.groups = append(row.groups, Submeta(full, vars))
+		}
+		for i, g := range row.groups {
+			if prev == nil || !g.Equal(prev[i]) {
+				row.headings = row.groups[i:]
+				break
+			}
+		}
+		prev = row.groups
+	}
+	return rows
+}
+
+func (s *Section) Meta() ingest.Metadata {
+	return s.meta
+}
+
+// Sections are the sections directly below s.
+func (s *Section) Sections() []*Section {
+	return s.sections
+}
+
+// Charts are the charts directly in s (not in the sections below it).
+func (s *Section) Charts() []*Chart {
+	return s.charts
+}
+
+// Add puts c at the end of s.
+func (s *Section) Add(c *Chart) {
+	s.charts = append(s.charts, c)
+}
+
+// AllCharts are the charts in s and in the sections below it, in the order
+// they are shown.
+func (s *Section) AllCharts() []*Chart {
+	var charts []*Chart
+	for _, sub := range s.sections {
+		charts = append(charts, sub.AllCharts()...)
+	}
+	return append(charts, s.charts...)
+}
+
+func (s *Section) Images() []*ingest.Image {
+	var images []*ingest.Image
+	for _, c := range s.AllCharts() {
+		images = append(images, c.Images()...)
+	}
+	return images
+}
+
+func (s *Section) Subgroups() []Images {
+	list := make([]Images, 0, len(s.sections) + len(s.charts))
+	for _, sub := range s.sections {
+		list = append(list, sub)
+	}
+	for _, c := range s.charts {
+		list = append(list, c)
+	}
+	return list
+}
@@ -0,0 +1,193 @@
+package charts
+
+import "testing"
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+func TestMakeLayout(t *testing.T) {
+	var images []*ingest.Image
+	for _, subject := range []string{"rat-1", "rat-2"} {
+		for _, region := range []string{"L1", "L2"} {
+			for _, z := range []string{"1", "2"} {
+				for _, stain := range []string{"DAPI", "FITC"} {
+					images = append(images, &ingest.Image{
+						Path: fmt.Sprintf("%v-%v-%v-%v", subject, region, z, stain),
+						Metadata: ingest.Metadata{"subject": subject, "slide": "1", "region": region, "z": z, "stain": stain},
+					})
+				}
+			}
+		}
+	}
+	l := &Layout{
+		Sections: [][]string{{"subject"}},
+		Charts: []string{"slide"},
+		RowGroups: [][]string{{"region"}},
+		Rows: []string{"z"},
+		Columns: []string{"stain"},
+	}
+	root, err := MakeLayout(images, l, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Sections()) != 2 || len(root.Charts()) != 0 {
+		t.Fatal("expected a section per subject", root.Sections(), root.Charts())
+	}
+	if len(root.AllCharts()) != 2 || len(root.Images()) != len(images) {
+		t.Fatal("expected every image in a chart", root.AllCharts(), root.Images())
+	}
+	for _, section := range root.Sections() {
+		chart := section.Charts()[0]
+		if len(chart.Rows()) != 4 {
+			t.Fatal("expected a row per region and z", chart.Rows())
+		}
+		for i, row := range chart.Rows() {
+			if len(row.Meta()) != 1 || row.Meta()["z"] != fmt.Sprint(i%2 + 1) {
+				t.Fatal("expected the rows to be named by z", i, row.Meta())
+			}
+			if (i%2 == 0) != (len(row.Headings()) == 1) {
+				t.Fatal("expected a heading at the first row of each region", i, row.Headings())
+			}
+			for _, img := range row.Images() {
+				if img.Meta()["subject"] != section.Meta()["subject"] || img.Meta()["z"] != row.Meta()["z"] {
+					t.Fatal("image in the wrong place", img, section.Meta(), row.Meta())
+				}
+			}
+		}
+		if chart.Rows()[2].Headings()[0]["region"] != "L2" {
+			t.Fatal("wrong heading", chart.Rows()[2].Headings())
+		}
+	}
+	out, err := LayoutHTML(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(out)
+	if strings.Count(html, `class="section-info"`) != 2 || strings.Count(html, `class="chart-row-group-name"`) != 4 {
+		t.Fatal("expected the sections and row groups in the html")
+	}
+}
+
+func TestTranspose(t *testing.T) {
+	var images []*ingest.Image
+	for _, region := range []string{"L1", "L2", "L3"} {
+		for _, stain := range []string{"DAPI", "FITC"} {
+			for _, z := range []string{"1", "2"} {
+				images = append(images, &ingest.Image{
+					Path: region + "-" + stain + "-" + z,
+					Metadata: ingest.Metadata{"slide": "1", "region": region, "stain": stain, "z": z},
+				})
+			}
+		}
+	}
+	l := &Layout{Charts: []string{"slide"}, Rows: []string{"region"}, Columns: []string{"stain", "z"}}
+	if err := l.Transpose(); err != nil {
+		t.Fatal(err)
+	}
+	root, err := MakeLayout(images, l, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chart := root.AllCharts()[0]
+	if len(chart.Rows()) != 4 || len(chart.Columns()) != 3 {
+		t.Fatal("expected a row per stain and z and a column per region", chart.Rows(), chart.Columns())
+	}
+	labels := [][]string{{"DAPI", "1"}, {"", "2"}, {"FITC", "1"}, {"", "2"}}
+	for i, names := range chart.RowLabels() {
+		for j, name := range names {
+			if name != labels[i][j] {
+				t.Fatal("wrong row label", i, j, name, labels[i][j])
+			}
+		}
+	}
+	for i, row := range chart.Rows() {
+		for j, img := range row.Images() {
+			m := img.Meta()
+			if m["region"] != chart.Columns()[j].Meta()["region"] || m["stain"] != row.Meta()["stain"] || m["z"] != row.Meta()["z"] {
+				t.Fatal("image in the wrong cell", i, j, img)
+			}
+		}
+	}
+	if len(chart.Corner()) != 1 {
+		t.Fatal("expected a corner cell over the first row label", chart.Corner())
+	}
+	grouped := &Layout{RowGroups: [][]string{{"slide"}}, Rows: []string{"region"}, Columns: []string{"stain"}}
+	if err := grouped.Transpose(); err == nil {
+		t.Fatal("expected an error transposing a layout with row groups")
+	}
+}
+
+func TestNamedOverlays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlays")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var images []*ingest.Image
+	for _, region := range []string{"L1", "L2"} {
+		for i, stain := range []string{"DAPI", "FITC", "TRITC"} {
+			path := filepath.Join(dir, region + " " + stain + ".png")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = png.Encode(f, speckles(40, 30, 10, image.Pt(i, 0)))
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			images = append(images, &ingest.Image{
+				Path: path,
+				Metadata: ingest.Metadata{"slide": "1", "region": region, "stain": stain},
+			})
+		}
+	}
+	merge, err := ParseOverlayDef("merge=DAPI,FITC,TRITC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nuclei, err := ParseOverlayDef("nuclei+gfp=DAPI,FITC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Layout{
+		Charts: []string{"slide"},
+		Rows: []string{"region"},
+		Columns: []string{"stain"},
+		OverlayOn: "stain",
+		Overlays: []*OverlayDef{nuclei, merge},
+	}
+	columns := func() []string {
+		root, err := MakeLayout(images, l, &OverlayOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chart := root.AllCharts()[0]
+		if len(chart.Missing()) != 0 {
+			t.Fatal("expected both overlays in every row", chart.Missing())
+		}
+		return chart.Headers()[0]
+	}
+	check := func(got []string, expected ...string) {
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Fatal("wrong columns", got, expected)
+		}
+	}
+	check(columns(), "DAPI", "FITC", "TRITC", "merge", "nuclei+gfp")
+	l.Orders = Orders{"stain": &Order{Values: []string{"merge", "TRITC", "FITC", "DAPI"}}}
+	check(columns(), "merge", "TRITC", "FITC", "DAPI", "nuclei+gfp")
+	if _, err := ParseOverlayDef("merge=DAPI"); err == nil {
+		t.Fatal("expected an error for an overlay of one value")
+	}
+}
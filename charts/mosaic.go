@@ -0,0 +1,268 @@
+package charts
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+	"github.com/disintegration/imaging"
+)
+
+
+type MosaicOptions struct {
+	// the variables giving the row and column of a tile in the grid.
+	Row, Col string
+	// the fraction of each tile which overlaps its neighbor (0 <= Overlap < 1).
+	Overlap float64
+	// refine the position of each tile by phase correlating the overlapping
+	// strips of its neighbors.
+	Refine bool
+	// writes the mosaics.
+	ingest.Previews
+}
+
+type tile struct {
+	img *ingest.Image
+	row, col int
+	pix image.Image
+	at image.Point
+}
+
+// Mosaic stitches the tiles of tiled acquisitions into a single image. The
+// tiles of a mosaic share all of their metadata except for the Row and Col
+// variables. Images without both variables are left as they are, as are the
+// tiles of mosaics which can not be stitched.
+func Mosaic(images []*ingest.Image, opts *MosaicOptions) ([]*ingest.Image, error) {
+	if opts.Overlap < 0 || opts.Overlap >= 1 {
+		return nil, fmt.Errorf("mosaic overlap must be in [0, 1) got %v", opts.Overlap)
+	}
+	tiles := make([]Images, 0, len(images))
+	stitched := make([]*ingest.Image, 0, len(images))
+	keys := make(map[string]bool)
+	for _, img := range images {
+		_, hasRow := img.Meta()[opts.Row]
+		_, hasCol := img.Meta()[opts.Col]
+		if !hasRow || !hasCol {
+			stitched = append(stitched, img)
+			continue
+		}
+		tiles = append(tiles, img)
+		for k := range img.Meta() {
+			if k != opts.Row && k != opts.Col {
+				keys[k] = true
+			}
+		}
+	}
+	on := make([]string, 0, len(keys))
+	for k := range keys {
+		on = append(on, k)
+	}
+	sort.Strings(on)
+	groups, metas := Group(tiles, on, nil)
+	if len(on) == 0 && len(tiles) > 0 {
+		// every tile belongs to the same mosaic
+		groups, metas = [][]Images{tiles}, []ingest.Metadata{make(ingest.Metadata)}
+	}
+	for i, group := range groups {
+		img, err := opts.Stitch(imagesAsImageList(group), metas[i])
+		if err != nil {
+			log.Println("WARN", "not stitching the mosaic of", metas[i], "because", err)
+			stitched = append(stitched, imagesAsImageList(group)...)
+			continue
+		}
+		stitched = append(stitched, img)
+	}
+	return stitched, nil
+}
+
+// Stitch places the tiles of one mosaic on a canvas and writes the result
+// next to the first tile.
+func (opts *MosaicOptions) Stitch(images []*ingest.Image, meta ingest.Metadata) (*ingest.Image, error) {
+	if len(images) == 1 {
+		return images[0], nil
+	}
+	common := make(ingest.Metadata, len(meta))
+	for k, v := range meta {
+		if v != "" {
+			common[k] = v
+		}
+	}
+	meta = common
+	path := MosaicName(images, opts)
+	fi, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil && fi.Size() > 0 {
+		return &ingest.Image{Path: path, Metadata: meta, PixelSize: images[0].PixelSize}, nil
+	}
+	rows := gridIndex(images, opts.Row)
+	cols := gridIndex(images, opts.Col)
+	grid := make(map[image.Point]*tile, len(images))
+	tiles := make([]*tile, 0, len(images))
+	var size image.Point
+	for _, img := range images {
+		t := &tile{img: img, row: rows[img.Meta()[opts.Row]], col: cols[img.Meta()[opts.Col]]}
+		if _, has := grid[image.Pt(t.col, t.row)]; has {
+			return nil, fmt.Errorf("two tiles at row %v col %v: %v",
+				img.Meta()[opts.Row], img.Meta()[opts.Col], img.Path)
+		}
+		t.pix, err = ingest.LoadImage(img.Path)
+		if err != nil {
+			return nil, err
+		}
+		if s := t.pix.Bounds().Size(); s.X > size.X || s.Y > size.Y {
+			size = s
+		}
+		grid[image.Pt(t.col, t.row)] = t
+		tiles = append(tiles, t)
+	}
+	sort.Sort(tilesByPosition(tiles))
+	step := image.Pt(
+		int(float64(size.X)*(1 - opts.Overlap) + .5),
+		int(float64(size.Y)*(1 - opts.Overlap) + .5),
+	)
+	for _, t := range tiles {
+		t.at = image.Pt(t.col*step.X, t.row*step.Y)
+		if !opts.Refine {
+			continue
+		}
+		if left, has := grid[image.Pt(t.col - 1, t.row)]; has {
+			t.at = left.at.Add(image.Pt(step.X, 0)).Add(opts.refine(left, t, true))
+		} else if up, has := grid[image.Pt(t.col, t.row - 1)]; has {
+			t.at = up.at.Add(image.Pt(0, step.Y)).Add(opts.refine(up, t, false))
+		}
+	}
+	bounds := image.Rectangle{tiles[0].at, tiles[0].at}
+	for _, t := range tiles {
+		bounds = bounds.Union(image.Rectangle{t.at, t.at.Add(t.pix.Bounds().Size())})
+	}
+	canvas := imaging.New(bounds.Dx(), bounds.Dy(), image.Black)
+	for _, t := range tiles {
+		canvas = imaging.Paste(canvas, t.pix, t.at.Sub(bounds.Min))
+	}
+	err = opts.WritePreview(path, canvas)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &ingest.Image{Path: path, Metadata: meta, PixelSize: images[0].PixelSize}, nil
+}
+
+// refine estimates how far cur is from its nominal position next to prev by
+// phase correlating the strips where the two tiles overlap. Corrections larger
+// than half of the overlap are not trusted.
+func (opts *MosaicOptions) refine(prev, cur *tile, horizontal bool) image.Point {
+	ps := prev.pix.Bounds()
+	cs := cur.pix.Bounds()
+	var a, b image.Rectangle
+	var limit int
+	if horizontal {
+		w := int(float64(ps.Dx())*opts.Overlap)
+		h := smaller(ps.Dy(), cs.Dy())
+		a = image.Rect(ps.Max.X - w, ps.Min.Y, ps.Max.X, ps.Min.Y + h)
+		b = image.Rect(cs.Min.X, cs.Min.Y, cs.Min.X + w, cs.Min.Y + h)
+		limit = w/2
+	} else {
+		w := smaller(ps.Dx(), cs.Dx())
+		h := int(float64(ps.Dy())*opts.Overlap)
+		a = image.Rect(ps.Min.X, ps.Max.Y - h, ps.Min.X + w, ps.Max.Y)
+		b = image.Rect(cs.Min.X, cs.Min.Y, cs.Min.X + w, cs.Min.Y + h)
+		limit = h/2
+	}
+	if a.Dx() < 2 || a.Dy() < 2 {
+		return image.Pt(0, 0)
+	}
+	shift := TranslationRegistration.Register(imaging.Crop(prev.pix, a), imaging.Crop(cur.pix, b))
+	if shift.X > limit || shift.X < -limit || shift.Y > limit || shift.Y < -limit {
+		return image.Pt(0, 0)
+	}
+	return shift
+}
+
+// gridIndex maps the values of a tile position variable to 0-based grid
+// indices. Numeric values are placed by their value, others alphabetically.
+func gridIndex(images []*ingest.Image, key string) map[string]int {
+	seen := make(map[string]bool)
+	vals := make([]string, 0, len(images))
+	numeric := true
+	for _, img := range images {
+		v := img.Meta()[key]
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		vals = append(vals, v)
+		if _, err := strconv.Atoi(v); err != nil {
+			numeric = false
+		}
+	}
+	index := make(map[string]int, len(vals))
+	if numeric {
+		least := 0
+		for i, v := range vals {
+			n, _ := strconv.Atoi(v)
+			if i == 0 || n < least {
+				least = n
+			}
+		}
+		for _, v := range vals {
+			n, _ := strconv.Atoi(v)
+			index[v] = n - least
+		}
+		return index
+	}
+	sort.Strings(vals)
+	for i, v := range vals {
+		index[v] = i
+	}
+	return index
+}
+
+type tilesByPosition []*tile
+
+func (t tilesByPosition) Len() int {
+	return len(t)
+}
+
+func (t tilesByPosition) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+func (t tilesByPosition) Less(i, j int) bool {
+	if t[i].row != t[j].row {
+		return t[i].row < t[j].row
+	}
+	return t[i].col < t[j].col
+}
+
+func smaller(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// MosaicName is where a stitched mosaic is written. The tile names are hashed
+// as a mosaic can have many tiles.
+func MosaicName(images []*ingest.Image, opts *MosaicOptions) string {
+	dir := filepath.Dir(images[0].Path)
+	h := fnv.New32a()
+	for _, img := range images {
+		h.Write([]byte(filepath.Base(img.Path)))
+		h.Write([]byte{0})
+	}
+	fmt.Fprintf(h, "%v %v", opts.Overlap, opts.Refine)
+	first := filepath.Base(images[0].Path)
+	first = strings.TrimSuffix(first, filepath.Ext(first))
+	name := fmt.Sprintf("mosaic::%v::%08x%v", first, h.Sum32(), opts.PreviewExt())
+	return filepath.Join(dir, name)
+}
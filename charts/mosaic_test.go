@@ -0,0 +1,82 @@
+package charts
+
+import "testing"
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+	"github.com/disintegration/imaging"
+)
+
+func TestMosaic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scene := speckles(400, 300, 600, image.Pt(0, 0))
+	// the stage overshot the second column by 6 pixels
+	at := map[image.Point]image.Point{
+		{0, 0}: {0, 0}, {1, 0}: {166, 0},
+		{0, 1}: {0, 112}, {1, 1}: {160, 112},
+	}
+	images := []*ingest.Image{{Path: "other", Metadata: ingest.Metadata{"region": "L2"}}}
+	for pos, pt := range at {
+		path := filepath.Join(dir, fmt.Sprintf("L1 %d_%d.jpeg", pos.Y, pos.X))
+		err := ingest.WriteJpeg(path, imaging.Crop(scene, image.Rect(pt.X, pt.Y, pt.X + 200, pt.Y + 140)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, &ingest.Image{
+			Path: path,
+			Metadata: ingest.Metadata{
+				"region": "L1",
+				"row": fmt.Sprint(pos.Y + 1),
+				"col": fmt.Sprint(pos.X + 1),
+			},
+		})
+	}
+	for _, c := range []struct{refine bool; size image.Point}{
+		{false, image.Pt(360, 252)},
+		{true, image.Pt(366, 252)},
+	} {
+		stitched, err := Mosaic(images, &MosaicOptions{Row: "row", Col: "col", Overlap: .2, Refine: c.refine})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stitched) != 2 || stitched[0].Path != "other" {
+			t.Fatal("expected the lone image and one mosaic got", stitched)
+		}
+		if !stitched[1].Meta().Equal(ingest.Metadata{"region": "L1"}) {
+			t.Fatal("unexpected mosaic metadata", stitched[1].Meta())
+		}
+		img, err := ingest.LoadImage(stitched[1].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Size() != c.size {
+			t.Fatal("refine", c.refine, "expected", c.size, "got", img.Bounds().Size())
+		}
+	}
+}
+
+func TestMosaicKeepsFailedTiles(t *testing.T) {
+	images := []*ingest.Image{
+		{Path: "/does/not/exist/0_0.png", Metadata: ingest.Metadata{"region": "L1", "row": "0", "col": "0"}},
+		{Path: "/does/not/exist/0_1.png", Metadata: ingest.Metadata{"region": "L1", "row": "0", "col": "1"}},
+	}
+	stitched, err := Mosaic(images, &MosaicOptions{Row: "row", Col: "col", Overlap: .1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stitched) != 2 {
+		t.Fatal("expected the tiles which could not be read to be kept", stitched)
+	}
+}
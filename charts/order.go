@@ -0,0 +1,146 @@
+package charts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+
+// Orders are how the values of each variable are sorted, for the charts, the
+// rows and the columns alike. Variables without an order (all of them when
+// the Orders are nil) are sorted alphabetically.
+type Orders map[string]*Order
+
+// Order is how the values of a variable are sorted.
+type Order struct {
+	// values listed here come first, in the order listed. the others come
+	// after them.
+	Values []string
+	// Natural compares the runs of digits in the values as numbers, so L2
+	// comes before L10.
+	Natural bool
+	// Numeric compares the values as numbers (which come before the values
+	// which are not numbers).
+	Numeric bool
+	Descending bool
+}
+
+// ParseOrder parses <var>=<order> where the order is either a list of values
+// (eg. stain=TRITC,FITC,DAPI) or one of alpha, natural or numeric, optionally
+// followed by -desc (eg. region=natural-desc). desc alone is alpha-desc.
+func ParseOrder(s string) (string, *Order, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		return "", nil, fmt.Errorf("expected <var>=<order> got '%v'", s)
+	}
+	name, spec := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	kind := strings.TrimSuffix(spec, "-desc")
+	desc := kind != spec || kind == "desc"
+	o := &Order{}
+	switch kind {
+	case "alpha", "desc":
+		o.Descending = desc
+	case "natural":
+		o.Natural, o.Descending = true, desc
+	case "numeric":
+		o.Numeric, o.Descending = true, desc
+	default:
+		for _, v := range strings.Split(spec, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				o.Values = append(o.Values, v)
+			}
+		}
+	}
+	return name, o, nil
+}
+
+// Compare is negative when a sorts before b, 0 when they are the same and
+// positive otherwise. A nil Order is alphabetical.
+func (o *Order) Compare(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if o == nil {
+		return strings.Compare(a, b)
+	}
+	c := o.compare(a, b)
+	if o.Descending {
+		return -c
+	}
+	return c
+}
+
+func (o *Order) compare(a, b string) int {
+	if len(o.Values) > 0 {
+		ra, rb := o.rank(a), o.rank(b)
+		if ra != rb {
+			return ra - rb
+		}
+	}
+	if o.Numeric {
+		fa, errA := strconv.ParseFloat(a, 64)
+		fb, errB := strconv.ParseFloat(b, 64)
+		switch {
+		case errA == nil && errB == nil && fa < fb:
+			return -1
+		case errA == nil && errB == nil && fa > fb:
+			return 1
+		case errA == nil && errB != nil:
+			return -1
+		case errA != nil && errB == nil:
+			return 1
+		}
+	}
+	if o.Natural {
+		if c := naturalCompare(a, b); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// rank is the position of v in Values, or len(Values) if it is not listed.
+func (o *Order) rank(v string) int {
+	for i, x := range o.Values {
+		if x == v {
+			return i
+		}
+	}
+	return len(o.Values)
+}
+
+// naturalCompare compares a and b a run of digits or non digits at a time,
+// with the runs of digits compared as numbers.
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		ra, restA := run(a)
+		rb, restB := run(b)
+		if isDigit(ra[0]) && isDigit(rb[0]) {
+			na, nb := strings.TrimLeft(ra, "0"), strings.TrimLeft(rb, "0")
+			if len(na) != len(nb) {
+				return len(na) - len(nb)
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+		} else if c := strings.Compare(ra, rb); c != 0 {
+			return c
+		}
+		a, b = restA, restB
+	}
+	return len(a) - len(b)
+}
+
+// run splits the leading run of digits or non digits off of s.
+func run(s string) (string, string) {
+	i := 1
+	for i < len(s) && isDigit(s[i]) == isDigit(s[0]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
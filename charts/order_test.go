@@ -0,0 +1,75 @@
+package charts
+
+import "testing"
+
+import (
+	"sort"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+func TestOrders(t *testing.T) {
+	sorted := func(spec string, vals ...string) []string {
+		_, o, err := ParseOrder("x=" + spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals = append([]string{}, vals...)
+		sort.SliceStable(vals, func(i, j int) bool { return o.Compare(vals[i], vals[j]) < 0 })
+		return vals
+	}
+	check := func(got []string, expected ...string) {
+		for i := range expected {
+			if got[i] != expected[i] {
+				t.Fatal("wrong order", got, expected)
+			}
+		}
+	}
+	check(sorted("alpha", "L2", "L10", "L1"), "L1", "L10", "L2")
+	check(sorted("natural", "L2", "L10", "L1", "L02b"), "L1", "L2", "L02b", "L10")
+	check(sorted("natural-desc", "L2", "L10", "L1"), "L10", "L2", "L1")
+	check(sorted("numeric", "10", "x", "2.5", "-1"), "-1", "2.5", "10", "x")
+	check(sorted("desc", "a", "c", "b"), "c", "b", "a")
+	check(sorted("TRITC,FITC,DAPI", "Cy5", "DAPI", "FITC", "TRITC"), "TRITC", "FITC", "DAPI", "Cy5")
+	if _, _, err := ParseOrder("stain"); err == nil {
+		t.Fatal("expected an error for an order without a variable")
+	}
+}
+
+func TestOrderCharts(t *testing.T) {
+	var images []*ingest.Image
+	for _, region := range []string{"L10", "L2", "L1"} {
+		for _, stain := range []string{"DAPI", "FITC", "TRITC"} {
+			images = append(images, &ingest.Image{
+				Path: region + "-" + stain,
+				Metadata: ingest.Metadata{"slide": "slide-1", "region": region, "stain": stain},
+			})
+		}
+	}
+	l := &Layout{
+		Charts: []string{"slide"},
+		Rows: []string{"region"},
+		Columns: []string{"stain"},
+		Orders: Orders{
+			"stain": &Order{Values: []string{"TRITC", "FITC", "DAPI"}},
+			"region": &Order{Natural: true},
+		},
+	}
+	root, err := MakeLayout(images, l, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chart := root.AllCharts()[0]
+	paths := []string{
+		"L1-TRITC", "L1-FITC", "L1-DAPI",
+		"L2-TRITC", "L2-FITC", "L2-DAPI",
+		"L10-TRITC", "L10-FITC", "L10-DAPI",
+	}
+	for i, img := range chart.Images() {
+		if img.Path != paths[i] {
+			t.Fatal("wrong order", i, img.Path, paths[i])
+		}
+	}
+}
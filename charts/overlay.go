@@ -3,8 +3,10 @@ package charts
 import (
 	"fmt"
 	"image"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -14,21 +16,36 @@ import (
 )
 
 
-func Overlay(images []*ingest.Image) (*ingest.Image, error) {
+type OverlayOptions struct {
+	Register Registration
+	Sizes SizePolicy
+	// compute the colocalization of each pair of overlaid images (see
+	// Colocalize). Correction is applied to their original data first.
+	Colocalize bool
+	Correction *ingest.Correction
+	// writes the overlays.
+	ingest.Previews
+}
+
+func Overlay(images []*ingest.Image, opts *OverlayOptions) (*ingest.Image, error) {
+	if opts == nil {
+		opts = &OverlayOptions{}
+	}
 	if len(images) == 0 {
 		return nil, fmt.Errorf("empty slice was passed in")
 	} else if len(images) == 1 {
 		return images[0], nil
 	}
 	meta := CommonMeta(images)
-	path := OverlayName(images)
+	path := OverlayName(images, opts)
+	overlaid := &ingest.Image{Path: path, Metadata: meta, PixelSize: OverlayPixelSize(images)}
 	fi, err := os.Stat(path)
 	if err != nil && os.IsNotExist(err) {
 		// ok we will make it below
 	} else if err != nil {
 		return nil, err
-	} else if fi.Size() > 0 {
-		return &ingest.Image{path, meta}, nil
+	} else if fi.Size() > 0 && readOverlayNotes(overlaid, opts) {
+		return overlaid, nil
 	}
 	imgs := make([]image.Image, 0, len(images))
 	for _, i := range images {
@@ -38,18 +55,69 @@ func Overlay(images []*ingest.Image) (*ingest.Image, error) {
 		}
 		imgs = append(imgs, img)
 	}
+	imgs, err = opts.Sizes.MatchSizes(images, imgs)
+	if err != nil {
+		return nil, err
+	}
+	shifts := make([]string, 0, len(imgs))
+	offsets := []image.Point{image.ZP}
 	overlay := imgs[0]
 	for i := 1; i < len(imgs); i++ {
-		overlay = imaging.Overlay(overlay, imgs[i], image.Pt(0,0), .50)
+		at := opts.Register.Register(imgs[0], imgs[i])
+		if opts.Register != NoRegistration {
+			shifts = append(shifts, fmt.Sprintf("%v(%+d,%+d)", OverlayLabel(images[i], meta), at.X, at.Y))
+		}
+		offsets = append(offsets, at)
+		overlay = imaging.Overlay(overlay, imgs[i], at, .50)
 	}
-	err = ingest.WriteJpeg(path, overlay)
+	err = opts.WritePreview(path, overlay)
 	if err != nil {
 		return nil, err
 	}
-	return &ingest.Image{path, meta}, nil
+	if opts.Register != NoRegistration {
+		overlaid.SetNote("registration", strings.Join(shifts, " "))
+		err = ioutil.WriteFile(path + ".registration", []byte(overlaid.Note("registration") + "\n"), 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Colocalize {
+		colocs, err := Colocalize(images, imgs[0].Bounds().Size(), offsets, opts)
+		if err != nil {
+			return nil, err
+		}
+		err = writeColocs(path + ".colocalization", colocs)
+		if err != nil {
+			return nil, err
+		}
+		overlaid.SetNote("colocalization", ColocNote(colocs))
+	}
+	return overlaid, nil
 }
 
-func OverlayName(images []*ingest.Image) string {
+// readOverlayNotes reads the notes (the registration shifts and the
+// colocalization) written next to an overlay made by an earlier run. It is
+// false if a note the options ask for is missing, in which case the overlay
+// is made again.
+func readOverlayNotes(overlaid *ingest.Image, opts *OverlayOptions) bool {
+	if opts.Register != NoRegistration {
+		shifts, err := ioutil.ReadFile(overlaid.Path + ".registration")
+		if err != nil {
+			return false
+		}
+		overlaid.SetNote("registration", strings.TrimSpace(string(shifts)))
+	}
+	if opts.Colocalize {
+		colocs, err := ReadColocalization(overlaid)
+		if err != nil {
+			return false
+		}
+		overlaid.SetNote("colocalization", ColocNote(colocs))
+	}
+	return true
+}
+
+func OverlayName(images []*ingest.Image, opts *OverlayOptions) string {
 	dir := filepath.Dir(images[0].Path)
 	names := make([]string, 0, len(images))
 	for _, img := range images {
@@ -58,10 +126,53 @@ func OverlayName(images []*ingest.Image) string {
 		name = strings.TrimSuffix(name, ext)
 		names = append(names, name)
 	}
-	name := "overlay::" + strings.Join(names, ":") + ".jpeg"
+	prefix := "overlay"
+	var previews ingest.Previews
+	if opts != nil {
+		previews = opts.Previews
+	}
+	if opts != nil && opts.Register != NoRegistration {
+		prefix += "+" + opts.Register.String()
+	}
+	if opts != nil && opts.Sizes != RefuseMismatch {
+		prefix += "+" + opts.Sizes.String()
+	}
+	name := prefix + "::" + strings.Join(names, ":") + previews.PreviewExt()
 	return filepath.Join(dir, name)
 }
 
+// OverlayPixelSize is the smallest known pixel size of the images, as that is
+// the pixel size of the largest image when they are resampled to match.
+func OverlayPixelSize(images []*ingest.Image) float64 {
+	size := 0.0
+	for _, img := range images {
+		if img.PixelSize > 0 && (size == 0 || img.PixelSize < size) {
+			size = img.PixelSize
+		}
+	}
+	return size
+}
+
+// OverlayLabel names an image within an overlay by the metadata it does not
+// share with the rest of the overlay (eg. its stain).
+func OverlayLabel(img *ingest.Image, common ingest.Metadata) string {
+	keys := make([]string, 0, len(img.Meta()))
+	for k := range img.Meta() {
+		if _, has := common[k]; !has {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return filepath.Base(img.Path)
+	}
+	sort.Strings(keys)
+	vals := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vals = append(vals, img.Meta()[k])
+	}
+	return strings.Join(vals, "/")
+}
+
 func CommonMeta(images []*ingest.Image) ingest.Metadata {
 	meta := make(ingest.Metadata, len(images[0].Meta()))
 	kv: for k, v := range images[0].Meta() {
@@ -74,4 +185,3 @@ func CommonMeta(images []*ingest.Image) ingest.Metadata {
 	}
 	return meta
 }
-
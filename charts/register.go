@@ -0,0 +1,181 @@
+package charts
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/cmplx"
+)
+
+import (
+	"github.com/disintegration/imaging"
+)
+
+
+type Registration int
+
+const (
+	NoRegistration Registration = iota
+	TranslationRegistration
+)
+
+// the size (per side) of the downscaled copies the phase correlation runs
+// on. must be a power of two for the fft.
+const registrationSize = 256
+
+func ParseRegistration(s string) (Registration, error) {
+	switch s {
+	case "", "none":
+		return NoRegistration, nil
+	case "translation":
+		return TranslationRegistration, nil
+	default:
+		return NoRegistration, fmt.Errorf("unknown registration '%v' (expected none or translation)", s)
+	}
+}
+
+func (r Registration) String() string {
+	switch r {
+	case NoRegistration:
+		return "none"
+	case TranslationRegistration:
+		return "translation"
+	default:
+		return fmt.Sprintf("<registration %d>", int(r))
+	}
+}
+
+// Register computes the translation which moves img onto ref. Drawing img at
+// the returned point on top of ref lines the two up.
+func (r Registration) Register(ref, img image.Image) image.Point {
+	switch r {
+	case TranslationRegistration:
+		return PhaseCorrelate(ref, img).Mul(-1)
+	default:
+		return image.Pt(0, 0)
+	}
+}
+
+// PhaseCorrelate estimates how far img is shifted relative to ref. Both images
+// are downscaled to a common power of two size so they need not be the same
+// size. The returned shift is in the pixel coordinates of ref.
+func PhaseCorrelate(ref, img image.Image) image.Point {
+	n := registrationSize
+	rb := ref.Bounds()
+	for n > 1 && (n > rb.Dx() || n > rb.Dy()) {
+		n /= 2
+	}
+	if n < 2 {
+		return image.Pt(0, 0)
+	}
+	a := fft2(spectrumInput(ref, n), n, false)
+	b := fft2(spectrumInput(img, n), n, false)
+	cross := make([]complex128, n*n)
+	for i := range cross {
+		c := b[i] * cmplx.Conj(a[i])
+		if m := cmplx.Abs(c); m > 1e-12 {
+			cross[i] = c / complex(m, 0)
+		}
+	}
+	corr := fft2(cross, n, true)
+	peak := 0
+	for i := range corr {
+		if real(corr[i]) > real(corr[peak]) {
+			peak = i
+		}
+	}
+	px, py := peak%n, peak/n
+	if px > n/2 {
+		px -= n
+	}
+	if py > n/2 {
+		py -= n
+	}
+	sx := float64(rb.Dx()) / float64(n)
+	sy := float64(rb.Dy()) / float64(n)
+	return image.Pt(int(math.Floor(float64(px)*sx + .5)), int(math.Floor(float64(py)*sy + .5)))
+}
+
+// spectrumInput downscales img to n x n, converts it to luminance and applies
+// a hann window so the image edges do not dominate the correlation.
+func spectrumInput(img image.Image, n int) []complex128 {
+	small := imaging.Resize(img, n, n, imaging.Box)
+	data := make([]complex128, n*n)
+	var mean float64
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			i := small.PixOffset(x, y)
+			p := small.Pix[i:i+3]
+			v := .299*float64(p[0]) + .587*float64(p[1]) + .114*float64(p[2])
+			data[y*n+x] = complex(v, 0)
+			mean += v
+		}
+	}
+	mean /= float64(n*n)
+	for y := 0; y < n; y++ {
+		wy := .5 - .5*math.Cos(2*math.Pi*float64(y)/float64(n-1))
+		for x := 0; x < n; x++ {
+			wx := .5 - .5*math.Cos(2*math.Pi*float64(x)/float64(n-1))
+			data[y*n+x] = complex((real(data[y*n+x])-mean)*wx*wy, 0)
+		}
+	}
+	return data
+}
+
+// fft2 is a 2d fft over an n x n row major array, n must be a power of two.
+func fft2(data []complex128, n int, inverse bool) []complex128 {
+	out := make([]complex128, len(data))
+	copy(out, data)
+	col := make([]complex128, n)
+	for y := 0; y < n; y++ {
+		fft(out[y*n:(y+1)*n], inverse)
+	}
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			col[y] = out[y*n+x]
+		}
+		fft(col, inverse)
+		for y := 0; y < n; y++ {
+			out[y*n+x] = col[y]
+		}
+	}
+	if inverse {
+		scale := complex(1/float64(n*n), 0)
+		for i := range out {
+			out[i] *= scale
+		}
+	}
+	return out
+}
+
+// fft is an in place iterative radix-2 fft
+func fft(a []complex128, inverse bool) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	sign := -1.0
+	if inverse {
+		sign = 1.0
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u := a[start+k]
+				v := a[start+k+size/2] * wk
+				a[start+k] = u + v
+				a[start+k+size/2] = u - v
+				wk *= w
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package charts
+
+import "testing"
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+)
+
+func speckles(w, h, n int, shift image.Point) *image.Gray {
+	r := rand.New(rand.NewSource(7))
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := 0; i < n; i++ {
+		cx, cy := r.Intn(w), r.Intn(h)
+		for y := cy - 4; y <= cy + 4; y++ {
+			for x := cx - 4; x <= cx + 4; x++ {
+				img.SetGray(x + shift.X, y + shift.Y, color.Gray{255})
+			}
+		}
+	}
+	return img
+}
+
+func TestPhaseCorrelate(t *testing.T) {
+	ref := speckles(256, 256, 60, image.Pt(0, 0))
+	moved := speckles(256, 256, 60, image.Pt(12, -7))
+	shift := PhaseCorrelate(ref, moved)
+	if shift != image.Pt(12, -7) {
+		t.Fatal("expected shift (12,-7) got", shift)
+	}
+	if at := TranslationRegistration.Register(ref, moved); at != image.Pt(-12, 7) {
+		t.Fatal("expected registration (-12,7) got", at)
+	}
+	if at := NoRegistration.Register(ref, moved); at != image.Pt(0, 0) {
+		t.Fatal("expected no registration got", at)
+	}
+}
+
+func TestPhaseCorrelateScaled(t *testing.T) {
+	ref := speckles(512, 512, 60, image.Pt(0, 0))
+	moved := speckles(512, 512, 60, image.Pt(-20, 16))
+	shift := PhaseCorrelate(ref, moved)
+	if shift != image.Pt(-20, 16) {
+		t.Fatal("expected shift (-20,16) got", shift)
+	}
+}
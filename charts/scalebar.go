@@ -0,0 +1,54 @@
+package charts
+
+import (
+	"log"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+// BurnScaleBars replaces each image in the charts with a copy which has the
+// scale bar drawn on it. This happens after the overlays are made so they are
+// made from the unmarked images.
+func BurnScaleBars(charts []*Chart, bar *ingest.ScaleBar) {
+	for _, chart := range charts {
+		for _, row := range chart.rows {
+			for i, img := range row.images {
+				if isPlaceholder(img) {
+					continue
+				}
+				burned, err := bar.Burn(img)
+				if err != nil {
+					log.Println("WARN", "could not draw a scale bar on", img.Path, "because", err)
+					continue
+				}
+				row.images[i] = burned
+				if stack, has := row.stacks[img]; has {
+					delete(row.stacks, img)
+					row.stacks[burned] = burnStack(bar, stack, img, burned)
+				}
+			}
+		}
+	}
+}
+
+// burnStack burns the scale bar on the images of a stack, reusing the burned
+// copy of the image shown in the cell.
+func burnStack(bar *ingest.ScaleBar, stack []*ingest.Image, shown, shownBurned *ingest.Image) []*ingest.Image {
+	burned := make([]*ingest.Image, 0, len(stack))
+	for _, img := range stack {
+		if img == shown {
+			burned = append(burned, shownBurned)
+			continue
+		}
+		b, err := bar.Burn(img)
+		if err != nil {
+			log.Println("WARN", "could not draw a scale bar on", img.Path, "because", err)
+			b = img
+		}
+		burned = append(burned, b)
+	}
+	return burned
+}
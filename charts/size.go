@@ -0,0 +1,121 @@
+package charts
+
+import (
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+	"github.com/disintegration/imaging"
+)
+
+
+type SizePolicy int
+
+const (
+	RefuseMismatch SizePolicy = iota
+	ResampleToLargest
+	CropToIntersection
+)
+
+func ParseSizePolicy(s string) (SizePolicy, error) {
+	switch s {
+	case "", "refuse":
+		return RefuseMismatch, nil
+	case "resample":
+		return ResampleToLargest, nil
+	case "crop":
+		return CropToIntersection, nil
+	default:
+		return RefuseMismatch, fmt.Errorf("unknown size policy '%v' (expected refuse, resample or crop)", s)
+	}
+}
+
+func (p SizePolicy) String() string {
+	switch p {
+	case RefuseMismatch:
+		return "refuse"
+	case ResampleToLargest:
+		return "resample"
+	case CropToIntersection:
+		return "crop"
+	default:
+		return fmt.Sprintf("<size-policy %d>", int(p))
+	}
+}
+
+type SizeMismatchError struct {
+	Paths []string
+	Sizes []image.Point
+}
+
+func (e *SizeMismatchError) Error() string {
+	parts := make([]string, 0, len(e.Paths))
+	for i, path := range e.Paths {
+		parts = append(parts, fmt.Sprintf("%v (%dx%d)", filepath.Base(path), e.Sizes[i].X, e.Sizes[i].Y))
+	}
+	return fmt.Sprintf("images to overlay have different dimensions: %v", strings.Join(parts, ", "))
+}
+
+// MatchSizes brings the decoded images to a common size according to the
+// policy. It returns a *SizeMismatchError when the policy is RefuseMismatch
+// and the sizes differ.
+func (p SizePolicy) MatchSizes(images []*ingest.Image, imgs []image.Image) ([]image.Image, error) {
+	if len(imgs) == 0 {
+		return imgs, nil
+	}
+	sizes := make([]image.Point, 0, len(imgs))
+	same := true
+	for _, img := range imgs {
+		sizes = append(sizes, img.Bounds().Size())
+		if sizes[len(sizes)-1] != sizes[0] {
+			same = false
+		}
+	}
+	if same {
+		return imgs, nil
+	}
+	switch p {
+	case ResampleToLargest:
+		largest := sizes[0]
+		for _, s := range sizes {
+			if s.X*s.Y > largest.X*largest.Y {
+				largest = s
+			}
+		}
+		matched := make([]image.Image, 0, len(imgs))
+		for i, img := range imgs {
+			if sizes[i] == largest {
+				matched = append(matched, img)
+			} else {
+				matched = append(matched, imaging.Resize(img, largest.X, largest.Y, imaging.Lanczos))
+			}
+		}
+		return matched, nil
+	case CropToIntersection:
+		common := sizes[0]
+		for _, s := range sizes {
+			if s.X < common.X {
+				common.X = s.X
+			}
+			if s.Y < common.Y {
+				common.Y = s.Y
+			}
+		}
+		matched := make([]image.Image, 0, len(imgs))
+		for _, img := range imgs {
+			min := img.Bounds().Min
+			matched = append(matched, imaging.Crop(img, image.Rectangle{min, min.Add(common)}))
+		}
+		return matched, nil
+	default:
+		paths := make([]string, 0, len(images))
+		for _, img := range images {
+			paths = append(paths, img.Path)
+		}
+		return nil, &SizeMismatchError{Paths: paths, Sizes: sizes}
+	}
+}
@@ -0,0 +1,49 @@
+package charts
+
+import "testing"
+
+import (
+	"image"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+func TestMatchSizes(t *testing.T) {
+	images := []*ingest.Image{
+		{Path: "path/a.jpeg", Metadata: ingest.Metadata{"stain": "a"}},
+		{Path: "path/b.jpeg", Metadata: ingest.Metadata{"stain": "b"}},
+	}
+	imgs := []image.Image{
+		image.NewGray(image.Rect(0, 0, 100, 80)),
+		image.NewGray(image.Rect(0, 0, 50, 120)),
+	}
+	_, err := RefuseMismatch.MatchSizes(images, imgs)
+	if err == nil {
+		t.Fatal("expected a size mismatch error")
+	} else if _, ok := err.(*SizeMismatchError); !ok {
+		t.Fatal("expected a *SizeMismatchError got", err)
+	} else if !strings.Contains(err.Error(), "a.jpeg (100x80)") || !strings.Contains(err.Error(), "b.jpeg (50x120)") {
+		t.Fatal("error should list the offending files", err)
+	}
+	resampled, err := ResampleToLargest.MatchSizes(images, imgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range resampled {
+		if img.Bounds().Size() != image.Pt(100, 80) {
+			t.Fatal("expected 100x80 got", img.Bounds().Size())
+		}
+	}
+	cropped, err := CropToIntersection.MatchSizes(images, imgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range cropped {
+		if img.Bounds().Size() != image.Pt(50, 80) {
+			t.Fatal("expected 50x80 got", img.Bounds().Size())
+		}
+	}
+}
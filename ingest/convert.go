@@ -1,40 +1,19 @@
 package ingest
 
 import (
+	"fmt"
 	"image"
 	"image/jpeg"
-	_ "image/png"
-	_ "image/gif"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-import (
-	_ "golang.org/x/image/tiff"
-)
-
 
 func EncodeJpeg(img image.Image, to io.Writer) error {
-	return jpeg.Encode(to, img, &jpeg.Options{Quality: 75})
-}
-
-func Decode(r io.Reader) (image.Image, error) {
-	img, _, err := image.Decode(r)
-	if err != nil {
-		return nil, err
-	}
-	return img, nil
-}
-
-func LoadImage(path string) (image.Image, error) {
-	from, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer from.Close()
-	return Decode(from)
+	return jpeg.Encode(to, img, &jpeg.Options{Quality: DefaultJpegQuality})
 }
 
 func WriteJpeg(path string, img image.Image) error {
@@ -54,7 +33,64 @@ func ConvertToJpeg(from io.Reader, to io.Writer) error {
 	return EncodeJpeg(img, to)
 }
 
-func Jpeg(path string) (jpegPath string, err error) {
+// Converter turns the images found by Ingest into previews, correcting them
+// along the way.
+type Converter struct {
+	Correction *Correction
+	Previews
+	// when set, large pages (see LargeImagePixels) also get a pyramid of
+	// tiles this size (see WritePyramid). the pyramids are not corrected.
+	Pyramid int
+}
+
+// Convert makes the previews for the image at path. Files with several pages
+// (see Decoder) produce one image per page, each with the page metadata added
+// to meta.
+func (c *Converter) Convert(path string, meta Metadata) []*Image {
+	pages, err := ReadPages(path)
+	if err != nil {
+		log.Println("WARN", "could not read", path, "using it as it is. because", err)
+		return []*Image{{Path: path, Metadata: meta, Source: path}}
+	}
+	sidecar := SidecarPixelSize(path)
+	images := make([]*Image, 0, len(pages))
+	for i, page := range pages {
+		img := &Image{Metadata: meta, Source: path, PixelSize: page.PixelSize}
+		if len(pages) > 1 {
+			img.Page = i + 1
+			img.Metadata = make(Metadata, len(meta) + len(page.Metadata))
+			for k, v := range page.Metadata {
+				img.Metadata[k] = v
+			}
+			for k, v := range meta {
+				img.Metadata[k] = v
+			}
+		}
+		if sidecar > 0 {
+			img.PixelSize = sidecar
+		}
+		img.Path, err = c.Preview(path, img.Page, img.Metadata)
+		if err != nil {
+			log.Println("WARN", "could not make a preview of", path, "page", i + 1, "using the original. because", err)
+			img.Path = path
+		} else {
+			// downsampled previews have larger pixels
+			img.PixelSize *= float64(PreviewScale(path, i))
+		}
+		if c.Pyramid > 0 {
+			err = c.writePyramid(path, img.Page)
+			if err != nil {
+				log.Println("WARN", "could not make a pyramid of", path, "page", i + 1, "because", err)
+			}
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// Preview makes the preview for the 1-based page of the file at path (0 for
+// single page files).
+func (c *Converter) Preview(path string, page int, meta Metadata) (previewPath string, err error) {
 	path, err = filepath.Abs(path)
 	if err != nil {
 		return "", err
@@ -63,36 +99,92 @@ func Jpeg(path string) (jpegPath string, err error) {
 	name := filepath.Base(path)
 	ext := filepath.Ext(name)
 	name = strings.TrimSuffix(name, ext)
-	if ext == ".jpeg" || ext == ".jpg" {
+	if page == 0 && isPreviewExt(ext, c.Encoder) && !c.corrects(meta) {
 		return path, nil
 	}
-	jpegPath = filepath.Join(dir, name + ".jpeg")
-	fi, err := os.Stat(jpegPath)
+	if page > 0 {
+		name = fmt.Sprintf("%v.page-%d", name, page)
+	}
+	previewPath = filepath.Join(dir, name + c.suffix(meta))
+	fi, err := os.Stat(previewPath)
 	if err != nil && os.IsNotExist(err) {
 		// its ok the path isn't there
 	} else if err != nil {
 		return "", err
 	} else if fi.Size() > 0 {
-		return jpegPath, nil
+		return previewPath, nil
 	}
 
-	from, err := os.Open(path)
+	index := page - 1
+	if page == 0 {
+		index = 0
+	}
+	img, _, err := LoadPreview(path, index)
 	if err != nil {
 		return "", err
 	}
-	defer from.Close()
-
-	to, err := os.Create(jpegPath)
+	err = c.write(previewPath, img, meta)
 	if err != nil {
 		return "", err
 	}
-	defer to.Close()
+	return previewPath, nil
+}
 
-	err = ConvertToJpeg(from, to)
+// writePyramid writes the pyramid of the 1-based page (0 for single page
+// files) to a directory named like the preview with the extension
+// `.pyramid-<tile size>`. Pages which are not large are skipped.
+func (c *Converter) writePyramid(path string, page int) error {
+	index := page - 1
+	if page == 0 {
+		index = 0
+	}
+	if PreviewScale(path, index) == 1 {
+		return nil
+	}
+	name := strings.TrimSuffix(path, filepath.Ext(path))
+	if page > 0 {
+		name = fmt.Sprintf("%v.page-%d", name, page)
+	}
+	dir := fmt.Sprintf("%v.pyramid-%d", name, c.Pyramid)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	tmp := dir + ".partial"
+	os.RemoveAll(tmp)
+	err := WritePagePyramid(path, index, tmp, c.Pyramid, c.Encoder)
 	if err != nil {
-		os.Remove(jpegPath)
-		return "", err
+		os.RemoveAll(tmp)
+		return err
 	}
-	return jpegPath, nil
+	return os.Rename(tmp, dir)
+}
+
+func (c *Converter) corrects(meta Metadata) bool {
+	return c.Correction.Key(meta) != ""
 }
 
+// suffix keeps corrected previews from being confused with uncorrected ones,
+// or ones corrected with other references, made by an earlier run.
+func (c *Converter) suffix(meta Metadata) string {
+	if key := c.Correction.Key(meta); key != "" {
+		return ".corrected-" + key + c.PreviewExt()
+	}
+	return c.PreviewExt()
+}
+
+func (c *Converter) write(path string, img image.Image, meta Metadata) error {
+	img, err := c.Correction.Correct(img, meta)
+	if err != nil {
+		return err
+	}
+	err = c.WritePreview(path, img)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func IsTiff(path string) bool {
+	return hasExt(path, ".tif", ".tiff")
+}
@@ -0,0 +1,141 @@
+package ingest
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+// Page is one plane of an image file. Most files have a single page, but
+// multi-page tiffs and the microscope vendor formats can hold every channel,
+// z-slice and time point of an acquisition.
+type Page struct {
+	// metadata describing the page within the file (eg. its channel).
+	Metadata Metadata
+	// the width of a pixel in microns, 0 if unknown.
+	PixelSize float64
+}
+
+// Decoder reads one family of image files.
+type Decoder interface {
+	Name() string
+	// Match decides whether the decoder can read the file, from its path
+	// (eg. its extension) or contents (eg. its magic bytes).
+	Match(path string, r io.ReaderAt) bool
+	Pages(r io.ReaderAt) ([]Page, error)
+	// DecodePage decodes the 0-based page of the file.
+	DecodePage(r io.ReaderAt, page int) (image.Image, error)
+}
+
+var decoders []Decoder
+
+// RegisterDecoder adds a decoder. Decoders are tried in the order they were
+// registered so more specific decoders must be registered first.
+func RegisterDecoder(d Decoder) {
+	decoders = append(decoders, d)
+}
+
+func init() {
+	RegisterDecoder(&OmeTiffDecoder{})
+	RegisterDecoder(&TiffDecoder{})
+	RegisterDecoder(&StdDecoder{})
+}
+
+func FindDecoder(path string, r io.ReaderAt) (Decoder, error) {
+	for _, d := range decoders {
+		if d.Match(path, r) {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("no decoder for %v", filepath.Base(path))
+}
+
+// ReadPages lists the pages in the image file at path.
+func ReadPages(path string) ([]Page, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := FindDecoder(path, f)
+	if err != nil {
+		return nil, err
+	}
+	return d.Pages(f)
+}
+
+// LoadPage decodes the 0-based page of the image file at path.
+func LoadPage(path string, page int) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := FindDecoder(path, f)
+	if err != nil {
+		return nil, err
+	}
+	return d.DecodePage(f, page)
+}
+
+func LoadImage(path string) (image.Image, error) {
+	return LoadPage(path, 0)
+}
+
+func Decode(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func readHead(r io.ReaderAt, n int) []byte {
+	head := make([]byte, n)
+	n, _ = r.ReadAt(head, 0)
+	return head[:n]
+}
+
+// StdDecoder reads the single page formats registered with the image package
+// (jpeg, png and gif).
+type StdDecoder struct{}
+
+func (d *StdDecoder) Name() string {
+	return "image"
+}
+
+func (d *StdDecoder) Match(path string, r io.ReaderAt) bool {
+	head := readHead(r, 8)
+	return bytes.HasPrefix(head, []byte("\xFF\xD8")) ||
+		bytes.HasPrefix(head, []byte("\x89PNG")) ||
+		bytes.HasPrefix(head, []byte("GIF8"))
+}
+
+func (d *StdDecoder) Pages(r io.ReaderAt) ([]Page, error) {
+	return []Page{{Metadata: make(Metadata)}}, nil
+}
+
+func (d *StdDecoder) DecodePage(r io.ReaderAt, page int) (image.Image, error) {
+	if page != 0 {
+		return nil, fmt.Errorf("no page %d", page + 1)
+	}
+	return Decode(io.NewSectionReader(r, 0, 1<<62))
+}
+
+func hasExt(path string, exts ...string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range exts {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package ingest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+import (
+	"github.com/disintegration/imaging"
+)
+
+
+// Duplicate is a pair of images which look the same but have different
+// metadata, eg. the same file saved under two subject names.
+type Duplicate struct {
+	A, B *Image
+	// the number of bits the perceptual hashes of the images differ by.
+	Distance int
+	// the original files are byte for byte the same.
+	Exact bool
+}
+
+func (d *Duplicate) String() string {
+	kind := "near-duplicates"
+	if d.Exact {
+		kind = "duplicates"
+	}
+	return fmt.Sprintf("%v %v and %v %v are %v (distance %d)",
+		filepath.Base(d.A.Path), d.A.Meta(), filepath.Base(d.B.Path), d.B.Meta(), kind, d.Distance)
+}
+
+// PerceptualHash hashes what an image looks like rather than its bytes, so
+// images which were re-encoded, resized or slightly adjusted have hashes
+// which differ in only a few bits. It is the sign of the lowest frequencies
+// of the discrete cosine transform of the image shrunk to 32x32, relative to
+// their median.
+func PerceptualHash(img image.Image) uint64 {
+	const size, low = 32, 8
+	small := imaging.Grayscale(imaging.Resize(img, size, size, imaging.Box))
+	var px [size][size]float64
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			px[y][x] = float64(small.NRGBAAt(x, y).R)
+		}
+	}
+	var cos [low][size]float64
+	for u := 0; u < low; u++ {
+		for x := 0; x < size; x++ {
+			cos[u][x] = math.Cos(float64(2*x + 1) * float64(u) * math.Pi / (2 * size))
+		}
+	}
+	coeffs := make([]float64, 0, low*low)
+	for v := 0; v < low; v++ {
+		for u := 0; u < low; u++ {
+			sum := 0.0
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += px[y][x] * cos[u][x] * cos[v][y]
+				}
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+	// the first coefficient is the mean brightness, leave it out of the median
+	sorted := append([]float64{}, coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// FindDuplicates compares the previews of the images. Pairs whose perceptual
+// hashes differ by at most maxDistance bits are duplicates, unless they have
+// the same metadata or are pages of the same file (eg. neighboring slices of
+// a z-stack). The pairs are exact duplicates when their original files (the
+// Source, or the Path without one) are the same. Images which can not be
+// read are logged and left out of the comparison.
+func FindDuplicates(images []*Image, maxDistance int) []*Duplicate {
+	hashed := make([]*Image, 0, len(images))
+	hashes := make([]uint64, 0, len(images))
+	sums := make([][sha256.Size]byte, 0, len(images))
+	// the pages of a file share its sum
+	fileSums := make(map[string][sha256.Size]byte)
+	for _, img := range images {
+		pix, err := LoadImage(img.Path)
+		if err != nil {
+			log.Println("WARN", "not checking", img.Path, "for duplicates because", err)
+			continue
+		}
+		original := img.Source
+		if original == "" {
+			original = img.Path
+		}
+		sum, has := fileSums[original]
+		if !has {
+			sum, err = fileSum(original)
+			if err != nil {
+				log.Println("WARN", "not checking", img.Path, "for duplicates because", err)
+				continue
+			}
+			fileSums[original] = sum
+		}
+		hashed = append(hashed, img)
+		hashes = append(hashes, PerceptualHash(pix))
+		sums = append(sums, sum)
+	}
+	images = hashed
+	var dups []*Duplicate
+	for i := 0; i < len(images); i++ {
+		for j := i + 1; j < len(images); j++ {
+			a, b := images[i], images[j]
+			if a.Meta().Equal(b.Meta()) || (a.Source != "" && a.Source == b.Source) {
+				continue
+			}
+			distance := bits.OnesCount64(hashes[i] ^ hashes[j])
+			if distance > maxDistance {
+				continue
+			}
+			dups = append(dups, &Duplicate{A: a, B: b, Distance: distance, Exact: sums[i] == sums[j]})
+		}
+	}
+	return dups
+}
+
+func fileSum(path string) (sum [sha256.Size]byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
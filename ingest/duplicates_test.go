@@ -0,0 +1,86 @@
+package ingest
+
+import "testing"
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/disintegration/imaging"
+)
+
+// waves is a smooth pattern which varies with seed.
+func waves(w, h int, seed float64) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 128 + 100*math.Sin(float64(x)*seed/40)*math.Cos(float64(y)*(seed + 1)/30)
+			img.SetGray(x, y, color.Gray{uint8(v)})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHash(t *testing.T) {
+	a := waves(120, 90, 3)
+	same := imaging.AdjustBrightness(imaging.Resize(a, 80, 60, imaging.Lanczos), 5)
+	other := waves(120, 90, 7)
+	if d := bits.OnesCount64(PerceptualHash(a) ^ PerceptualHash(same)); d > 4 {
+		t.Fatal("expected the resized copy to be close got a distance of", d)
+	}
+	if d := bits.OnesCount64(PerceptualHash(a) ^ PerceptualHash(other)); d <= 10 {
+		t.Fatal("expected different images to be far apart got a distance of", d)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duplicates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, img image.Image) string {
+		path := filepath.Join(dir, name)
+		if err := WriteJpeg(path, img); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := waves(120, 90, 3)
+	images := []*Image{
+		{Path: write("1 a.jpeg", a), Metadata: Metadata{"subject": "a"}},
+		{Path: write("1 b.jpeg", a), Metadata: Metadata{"subject": "b"}},
+		{Path: write("1 c.jpeg", imaging.AdjustContrast(a, 5)), Metadata: Metadata{"subject": "c"}},
+		{Path: write("1 d.jpeg", waves(120, 90, 7)), Metadata: Metadata{"subject": "d"}},
+	}
+	dups := FindDuplicates(append(images, &Image{Path: filepath.Join(dir, "missing.jpeg")}), 4)
+	if len(dups) != 3 {
+		t.Fatal("expected a, b and c to be duplicates of each other got", dups)
+	}
+	if !dups[0].Exact || dups[0].A != images[0] || dups[0].B != images[1] {
+		t.Fatal("expected a and b to be exact duplicates got", dups[0])
+	}
+	if dups[1].Exact {
+		t.Fatal("expected a and c to be near-duplicates got", dups[1])
+	}
+	// the same preview made from different originals
+	sources := make([]*Image, 0, 2)
+	for _, subject := range []string{"e", "f"} {
+		source := filepath.Join(dir, "2 " + subject + ".raw")
+		if err := ioutil.WriteFile(source, []byte(subject), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, &Image{Path: images[0].Path, Source: source, Metadata: Metadata{"subject": subject}})
+	}
+	dups = FindDuplicates(sources, 4)
+	if len(dups) != 1 || dups[0].Exact {
+		t.Fatal("expected e and f to be near-duplicates got", dups)
+	}
+}
@@ -0,0 +1,125 @@
+package ingest
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+// Encoder writes the previews shown in the charts (and the overlays, mosaics,
+// etc. derived from them).
+type Encoder interface {
+	Encode(img image.Image, to io.Writer) error
+	// the extension of the files written, including the dot. it differs
+	// between settings so previews written with other settings are not reused.
+	Ext() string
+}
+
+type JpegEncoder struct {
+	Quality int
+}
+
+type PngEncoder struct{}
+
+const DefaultJpegQuality = 75
+
+// ParseEncoder parses 'jpeg', 'jpeg:<quality>' or 'png'.
+func ParseEncoder(s string) (Encoder, error) {
+	parts := strings.SplitN(s, ":", 2)
+	switch parts[0] {
+	case "jpeg", "jpg":
+		quality := DefaultJpegQuality
+		if len(parts) == 2 {
+			var err error
+			quality, err = strconv.Atoi(parts[1])
+			if err != nil || quality < 1 || quality > 100 {
+				return nil, fmt.Errorf("jpeg quality must be between 1 and 100 got '%v'", parts[1])
+			}
+		}
+		return &JpegEncoder{Quality: quality}, nil
+	case "png":
+		if len(parts) == 2 {
+			return nil, fmt.Errorf("png does not take any options got '%v'", parts[1])
+		}
+		return &PngEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown preview format '%v' (expected jpeg, jpeg:<quality> or png)", s)
+	}
+}
+
+func (e *JpegEncoder) Encode(img image.Image, to io.Writer) error {
+	return jpeg.Encode(to, img, &jpeg.Options{Quality: e.Quality})
+}
+
+func (e *JpegEncoder) Ext() string {
+	if e.Quality == DefaultJpegQuality {
+		return ".jpeg"
+	}
+	return fmt.Sprintf(".q%d.jpeg", e.Quality)
+}
+
+func (e *PngEncoder) Encode(img image.Image, to io.Writer) error {
+	return png.Encode(to, img)
+}
+
+func (e *PngEncoder) Ext() string {
+	return ".png"
+}
+
+// orDefault is enc, or a jpeg encoder with the default quality when enc is
+// nil.
+func orDefault(enc Encoder) Encoder {
+	if enc == nil {
+		return &JpegEncoder{Quality: DefaultJpegQuality}
+	}
+	return enc
+}
+
+// Previews is embedded in the options of everything which writes previews,
+// so they are all written the same way.
+type Previews struct {
+	// nil is jpeg with the default quality.
+	Encoder Encoder
+}
+
+func (p Previews) PreviewExt() string {
+	return PreviewExt(p.Encoder)
+}
+
+func (p Previews) WritePreview(path string, img image.Image) error {
+	return WritePreview(path, img, p.Encoder)
+}
+
+// PreviewExt is the extension of the previews written by WritePreview with
+// enc (nil is the default jpeg encoder).
+func PreviewExt(enc Encoder) string {
+	return orDefault(enc).Ext()
+}
+
+func WritePreview(path string, img image.Image, enc Encoder) error {
+	to, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	return orDefault(enc).Encode(img, to)
+}
+
+// isPreviewExt is true when a file with extension ext can be shown as it is
+// with previews written by enc.
+func isPreviewExt(ext string, enc Encoder) bool {
+	ext = strings.ToLower(ext)
+	switch orDefault(enc).(type) {
+	case *JpegEncoder:
+		return ext == ".jpeg" || ext == ".jpg"
+	case *PngEncoder:
+		return ext == ".png"
+	}
+	return false
+}
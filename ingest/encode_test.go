@@ -0,0 +1,45 @@
+package ingest
+
+import "testing"
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+)
+
+func TestParseEncoder(t *testing.T) {
+	for _, c := range []struct{spec, ext string}{
+		{"jpeg", ".jpeg"}, {"jpeg:75", ".jpeg"}, {"jpg:92", ".q92.jpeg"}, {"png", ".png"},
+	} {
+		e, err := ParseEncoder(c.spec)
+		if err != nil {
+			t.Fatal(c.spec, err)
+		}
+		if e.Ext() != c.ext {
+			t.Fatal(c.spec, "expected", c.ext, "got", e.Ext())
+		}
+	}
+	for _, spec := range []string{"jpeg:0", "jpeg:101", "jpeg:x", "png:3", "webm"} {
+		if _, err := ParseEncoder(spec); err == nil {
+			t.Fatal("expected an error for", spec)
+		}
+	}
+}
+
+func TestPngEncoderKeepsAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.SetNRGBA(1, 1, color.NRGBA{10, 20, 30, 40})
+	buf := new(bytes.Buffer)
+	err := (&PngEncoder{}).Encode(img, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := color.NRGBAModel.Convert(decoded.At(1, 1)); c != (color.NRGBA{10, 20, 30, 40}) {
+		t.Fatal("expected the pixel to survive got", c)
+	}
+}
@@ -0,0 +1,285 @@
+package ingest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/disintegration/imaging"
+)
+
+
+// Correction holds the flat-field and dark-frame references used to correct
+// uneven illumination. A reference applies to an image when all of the
+// reference's metadata (eg. its stain and objective) matches the image. The
+// most specific matching reference is used.
+type Correction struct {
+	Flats []*Image
+	Darks []*Image
+	loaded map[string]image.Image
+}
+
+// LoadReferences finds the reference images in dir. Their metadata comes from
+// parsing their names with format, same as for Ingest.
+func LoadReferences(dir string, format Format) ([]*Image, error) {
+	files, err := Files(dir)
+	if err != nil {
+		return nil, err
+	}
+	var refs []*Image
+	var path string
+	for path, err, files = files(); files != nil; path, err, files = files() {
+		meta, err := format.Parse([]byte(filepath.Base(path)))
+		if err != nil {
+			log.Println("WARN", "skipping reference", path, "because", err)
+			continue
+		}
+		refs = append(refs, &Image{Path: path, Metadata: meta, Source: path})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// Matching finds the flat-field and dark-frame for an image. Either may be
+// nil.
+func (c *Correction) Matching(meta Metadata) (flat, dark *Image) {
+	if c == nil {
+		return nil, nil
+	}
+	return matchReference(c.Flats, meta), matchReference(c.Darks, meta)
+}
+
+// Key identifies the references matching meta and when they were last
+// modified, so files made with other (or since changed) references are not
+// reused. It is "" when no reference matches.
+func (c *Correction) Key(meta Metadata) string {
+	flat, dark := c.Matching(meta)
+	if flat == nil && dark == nil {
+		return ""
+	}
+	h := fnv.New32a()
+	for _, ref := range []*Image{flat, dark} {
+		if ref != nil {
+			path, _ := filepath.Abs(ref.Path)
+			h.Write([]byte(path))
+			if fi, err := os.Stat(ref.Path); err == nil {
+				fmt.Fprint(h, fi.ModTime().UnixNano())
+			}
+		}
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func matchReference(refs []*Image, meta Metadata) *Image {
+	var best *Image
+	refs: for _, ref := range refs {
+		for k, v := range ref.Meta() {
+			if meta[k] != v {
+				continue refs
+			}
+		}
+		if best == nil || len(ref.Meta()) > len(best.Meta()) {
+			best = ref
+		}
+	}
+	return best
+}
+
+// Correct applies the matching flat-field and dark-frame to img. It returns
+// img unchanged if there are no matching references.
+func (c *Correction) Correct(img image.Image, meta Metadata) (image.Image, error) {
+	flat, dark := c.Matching(meta)
+	if flat == nil && dark == nil {
+		return img, nil
+	}
+	size := img.Bounds().Size()
+	flatImg, err := c.load(flat, size)
+	if err != nil {
+		return nil, err
+	}
+	darkImg, err := c.load(dark, size)
+	if err != nil {
+		return nil, err
+	}
+	return FlatFieldCorrect(img, flatImg, darkImg)
+}
+
+// load reads the reference. References larger than size (the size of the
+// image being corrected) are shrunk to it as large pages are downsampled
+// before they are corrected (see LoadPreview).
+func (c *Correction) load(ref *Image, size image.Point) (image.Image, error) {
+	if ref == nil {
+		return nil, nil
+	}
+	if c.loaded == nil {
+		c.loaded = make(map[string]image.Image)
+	}
+	key := fmt.Sprintf("%v@%v", ref.Path, size)
+	if img, has := c.loaded[key]; has {
+		return img, nil
+	}
+	img, err := ref.Original()
+	if err != nil {
+		return nil, err
+	}
+	if b := img.Bounds().Size(); b.X > size.X && b.Y > size.Y {
+		img = imaging.Resize(img, size.X, size.Y, imaging.Box)
+	}
+	c.loaded[key] = img
+	return img, nil
+}
+
+// FlatFieldCorrect computes (raw - dark) / (flat - dark) for each pixel. The
+// result is scaled by the mean of (flat - dark) so the corrected image keeps
+// the brightness of the original. Either flat or dark may be nil, in which
+// case only the other is applied.
+func FlatFieldCorrect(raw, flat, dark image.Image) (image.Image, error) {
+	b := raw.Bounds()
+	if err := checkReferences(b.Size(), flat, dark); err != nil {
+		return nil, err
+	}
+	gain := flatGain(flat, dark)
+	gray := raw.ColorModel() == color.GrayModel || raw.ColorModel() == color.Gray16Model
+	var out image.Image
+	var set func(x, y int, px [3]float64)
+	if gray {
+		g := image.NewGray16(image.Rect(0, 0, b.Dx(), b.Dy()))
+		set = func(x, y int, px [3]float64) {
+			g.SetGray16(x, y, color.Gray16{clamp16(px[0])})
+		}
+		out = g
+	} else {
+		c := image.NewRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+		set = func(x, y int, px [3]float64) {
+			c.SetRGBA64(x, y, color.RGBA64{clamp16(px[0]), clamp16(px[1]), clamp16(px[2]), 0xffff})
+		}
+		out = c
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			set(x, y, correctPixel(refAt(raw, x, y), x, y, flat, dark, gain))
+		}
+	}
+	return out, nil
+}
+
+// CorrectRows is Correct for a RowSource: each row is corrected as it is
+// read, so only the references are held in memory.
+func (c *Correction) CorrectRows(src RowSource, meta Metadata) (RowSource, error) {
+	flat, dark := c.Matching(meta)
+	if flat == nil && dark == nil {
+		return src, nil
+	}
+	size := src.Size()
+	flatImg, err := c.load(flat, size)
+	if err != nil {
+		return nil, err
+	}
+	darkImg, err := c.load(dark, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReferences(size, flatImg, darkImg); err != nil {
+		return nil, err
+	}
+	return &correctedRows{src, flatImg, darkImg, flatGain(flatImg, darkImg)}, nil
+}
+
+type correctedRows struct {
+	RowSource
+	flat, dark image.Image
+	gain [3]float64
+}
+
+func (r *correctedRows) Rows(fn func(y int, row []uint16) error) error {
+	ch := r.Channels()
+	return r.RowSource.Rows(func(y int, row []uint16) error {
+		for x := 0; x < len(row)/ch; x++ {
+			var raw [3]float64
+			for c := range raw {
+				raw[c] = float64(row[x*ch + c % ch])
+			}
+			px := correctPixel(raw, x, y, r.flat, r.dark, r.gain)
+			for c := 0; c < ch; c++ {
+				row[x*ch + c] = clamp16(px[c])
+			}
+		}
+		return fn(y, row)
+	})
+}
+
+func checkReferences(size image.Point, refs ...image.Image) error {
+	for _, ref := range refs {
+		if ref != nil && ref.Bounds().Size() != size {
+			return fmt.Errorf("reference is %v but the image is %v", ref.Bounds().Size(), size)
+		}
+	}
+	return nil
+}
+
+// refAt is the 16 bit red, green and blue of the pixel at x, y (relative to
+// the bounds of img), all 0 when img is nil.
+func refAt(img image.Image, x, y int) [3]float64 {
+	if img == nil {
+		return [3]float64{}
+	}
+	ib := img.Bounds()
+	r, g, bl, _ := img.At(ib.Min.X + x, ib.Min.Y + y).RGBA()
+	return [3]float64{float64(r), float64(g), float64(bl)}
+}
+
+// flatGain is the mean of (flat - dark) for each channel.
+func flatGain(flat, dark image.Image) [3]float64 {
+	var gain [3]float64
+	if flat == nil {
+		return gain
+	}
+	b := flat.Bounds()
+	var sum [3]float64
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			f, d := refAt(flat, x, y), refAt(dark, x, y)
+			for c := range sum {
+				sum[c] += f[c] - d[c]
+			}
+		}
+	}
+	for c := range gain {
+		gain[c] = sum[c] / float64(b.Dx()*b.Dy())
+	}
+	return gain
+}
+
+func correctPixel(raw [3]float64, x, y int, flat, dark image.Image, gain [3]float64) [3]float64 {
+	d := refAt(dark, x, y)
+	var px [3]float64
+	for c := range px {
+		px[c] = raw[c] - d[c]
+		if flat != nil {
+			f := refAt(flat, x, y)[c] - d[c]
+			if f < 1 {
+				f = 1
+			}
+			px[c] = px[c] / f * gain[c]
+		}
+	}
+	return px
+}
+
+func clamp16(v float64) uint16 {
+	if v < 0 {
+		return 0
+	} else if v > 0xffff {
+		return 0xffff
+	}
+	return uint16(v + .5)
+}
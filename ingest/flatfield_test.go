@@ -0,0 +1,126 @@
+package ingest
+
+import "testing"
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func TestFlatFieldCorrect(t *testing.T) {
+	raw := image.NewGray16(image.Rect(0, 0, 2, 1))
+	flat := image.NewGray16(image.Rect(0, 0, 2, 1))
+	dark := image.NewGray16(image.Rect(0, 0, 2, 1))
+	// the left pixel is in the vignetted corner, it gets half the light
+	raw.SetGray16(0, 0, color.Gray16{1100})
+	raw.SetGray16(1, 0, color.Gray16{2100})
+	flat.SetGray16(0, 0, color.Gray16{3100})
+	flat.SetGray16(1, 0, color.Gray16{6100})
+	dark.SetGray16(0, 0, color.Gray16{100})
+	dark.SetGray16(1, 0, color.Gray16{100})
+	img, err := FlatFieldCorrect(raw, flat, dark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := img.(*image.Gray16).Gray16At(0, 0).Y
+	right := img.(*image.Gray16).Gray16At(1, 0).Y
+	// (1100 - 100)/(3100 - 100) * 4500 == (2100 - 100)/(6100 - 100) * 4500
+	if left != 1500 || right != 1500 {
+		t.Fatal("expected an even 1500 got", left, right)
+	}
+	_, err = FlatFieldCorrect(raw, image.NewGray16(image.Rect(0, 0, 3, 3)), nil)
+	if err == nil {
+		t.Fatal("expected an error for a mismatched reference")
+	}
+}
+
+func TestCorrectRows(t *testing.T) {
+	raw := image.NewGray16(image.Rect(0, 0, 2, 1))
+	raw.SetGray16(0, 0, color.Gray16{1100})
+	raw.SetGray16(1, 0, color.Gray16{2100})
+	flat := image.NewGray16(image.Rect(0, 0, 2, 1))
+	flat.SetGray16(0, 0, color.Gray16{3100})
+	flat.SetGray16(1, 0, color.Gray16{6100})
+	dark := image.NewGray16(image.Rect(0, 0, 2, 1))
+	dark.SetGray16(0, 0, color.Gray16{100})
+	dark.SetGray16(1, 0, color.Gray16{100})
+	c := &Correction{
+		Flats: []*Image{{Path: "flat", Metadata: Metadata{}}},
+		Darks: []*Image{{Path: "dark", Metadata: Metadata{}}},
+		loaded: map[string]image.Image{
+			"flat@(2,1)": flat,
+			"dark@(2,1)": dark,
+		},
+	}
+	src, err := c.CorrectRows(ImageRows(raw), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.Rows(func(y int, row []uint16) error {
+		if row[0] != 1500 || row[1] != 1500 {
+			t.Fatal("expected an even 1500 got", row)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchReference(t *testing.T) {
+	c := &Correction{
+		Flats: []*Image{
+			{Path: "dapi", Metadata: Metadata{"stain": "DAPI"}},
+			{Path: "dapi-20x", Metadata: Metadata{"stain": "DAPI", "objective": "20x"}},
+			{Path: "fitc", Metadata: Metadata{"stain": "FITC"}},
+		},
+	}
+	for _, m := range []struct{meta Metadata; flat string}{
+		{Metadata{"stain": "DAPI", "objective": "20x", "region": "L1"}, "dapi-20x"},
+		{Metadata{"stain": "DAPI", "objective": "40x", "region": "L1"}, "dapi"},
+		{Metadata{"stain": "FITC", "region": "L1"}, "fitc"},
+		{Metadata{"stain": "TRITC", "region": "L1"}, ""},
+	} {
+		flat, dark := c.Matching(m.meta)
+		if dark != nil {
+			t.Fatal("there are no darks", dark)
+		}
+		if (flat == nil && m.flat != "") || (flat != nil && flat.Path != m.flat) {
+			t.Fatal(m.meta, "expected", m.flat, "got", flat)
+		}
+	}
+}
+
+func TestCorrectionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "references")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Correction{}
+	for _, stain := range []string{"DAPI", "FITC"} {
+		path := filepath.Join(dir, stain)
+		if err := ioutil.WriteFile(path, []byte(stain), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c.Flats = append(c.Flats, &Image{Path: path, Metadata: Metadata{"stain": stain}})
+	}
+	dapi := c.Key(Metadata{"stain": "DAPI"})
+	if dapi == "" || dapi == c.Key(Metadata{"stain": "FITC"}) {
+		t.Fatal("expected a key for each reference got", dapi)
+	}
+	if key := c.Key(Metadata{"stain": "TRITC"}); key != "" {
+		t.Fatal("expected no key without a reference got", key)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(c.Flats[0].Path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if c.Key(Metadata{"stain": "DAPI"}) == dapi {
+		t.Fatal("expected the key to change with the reference")
+	}
+}
@@ -1,6 +1,7 @@
 package ingest
 
 import (
+	"image"
 	"io/ioutil"
 	"log"
 	"os"
@@ -27,17 +28,56 @@ func (m Metadata) Equal(b Metadata) bool {
 type Image struct {
 	Path string
 	Metadata Metadata
+	// the file the image was converted from, if it was converted.
+	Source string
+	// the 1-based page of Source for multi-page files, otherwise 0.
+	Page int
+	// the width of a pixel in microns, 0 if unknown.
+	PixelSize float64
+	// what the analyses found out about the image (eg. its object count).
+	// unlike the metadata the notes do not tell the image apart from the
+	// others.
+	Notes map[string]string
 }
 
 func (i *Image) Meta() Metadata {
 	return i.Metadata
 }
 
+// Note is the note k, "" if the image does not have it.
+func (i *Image) Note(k string) string {
+	return i.Notes[k]
+}
+
+// SetNote sets the note k. The notes are copied first as the copies of an
+// image share them.
+func (i *Image) SetNote(k, v string) {
+	notes := make(map[string]string, len(i.Notes) + 1)
+	for nk, nv := range i.Notes {
+		notes[nk] = nv
+	}
+	notes[k] = v
+	i.Notes = notes
+}
+
+// Original loads the image as it was before it was converted to a preview.
+func (i *Image) Original() (image.Image, error) {
+	if i.Source == "" {
+		return LoadImage(i.Path)
+	} else if i.Page > 0 {
+		return LoadPage(i.Source, i.Page - 1)
+	}
+	return LoadImage(i.Source)
+}
+
 func (i *Image) Images() []*Image {
 	return []*Image{i}
 }
 
-func Ingest(dir string, format Format) (paths []*Image, err error) {
+func Ingest(dir string, format Format, conv *Converter) (paths []*Image, err error) {
+	if conv == nil {
+		conv = &Converter{}
+	}
 	files, err := Files(dir)
 	if err != nil {
 		return nil, err
@@ -49,15 +89,7 @@ func Ingest(dir string, format Format) (paths []*Image, err error) {
 		if err != nil {
 			log.Println("WARN", "skipping", path, "because", err)
 		} else {
-			var use string
-			jpeg, err := Jpeg(path)
-			if err != nil {
-				use = path
-				log.Println("WARN", "could not convert to jpeg", path, "using tiff. because", err)
-			} else {
-				use = jpeg
-			}
-			paths = append(paths, &Image{use, meta})
+			paths = append(paths, conv.Convert(path, meta)...)
 		}
 	}
 	if err != nil {
@@ -0,0 +1,198 @@
+package ingest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+)
+
+
+// OmeTiffDecoder reads OME-TIFFs: tiffs whose first page describes the
+// acquisition in OME-XML. The channel names, z-slices, time points and pixel
+// sizes of the pages come from the XML.
+type OmeTiffDecoder struct{}
+
+type omeXML struct {
+	Images []omeImage `xml:"Image"`
+}
+
+type omeImage struct {
+	Name string `xml:"Name,attr"`
+	Pixels struct {
+		DimensionOrder string `xml:"DimensionOrder,attr"`
+		SizeC int `xml:"SizeC,attr"`
+		SizeZ int `xml:"SizeZ,attr"`
+		SizeT int `xml:"SizeT,attr"`
+		PhysicalSizeX float64 `xml:"PhysicalSizeX,attr"`
+		PhysicalSizeXUnit string `xml:"PhysicalSizeXUnit,attr"`
+		Channels []struct {
+			Name string `xml:"Name,attr"`
+		} `xml:"Channel"`
+		TiffData []struct {
+			IFD *int `xml:"IFD,attr"`
+			FirstC int `xml:"FirstC,attr"`
+			FirstZ int `xml:"FirstZ,attr"`
+			FirstT int `xml:"FirstT,attr"`
+			PlaneCount *int `xml:"PlaneCount,attr"`
+		} `xml:"TiffData"`
+	} `xml:"Pixels"`
+}
+
+func (d *OmeTiffDecoder) Name() string {
+	return "ome-tiff"
+}
+
+func (d *OmeTiffDecoder) Match(path string, r io.ReaderAt) bool {
+	if !(&TiffDecoder{}).Match(path, r) {
+		return false
+	}
+	pages, _, err := TiffPages(r)
+	if err != nil || len(pages) == 0 {
+		return false
+	}
+	return isOmeXML(pages[0].Description)
+}
+
+func isOmeXML(desc string) bool {
+	desc = strings.TrimSpace(desc)
+	return strings.HasPrefix(desc, "<") && strings.Contains(desc, "<OME")
+}
+
+func (d *OmeTiffDecoder) Pages(r io.ReaderAt) ([]Page, error) {
+	tiffPages, _, err := TiffPages(r)
+	if err != nil {
+		return nil, err
+	}
+	var ome omeXML
+	err = xml.Unmarshal([]byte(tiffPages[0].Description), &ome)
+	if err != nil {
+		return nil, fmt.Errorf("bad OME-XML: %v", err)
+	}
+	pages := make([]Page, len(tiffPages))
+	for i := range pages {
+		pages[i] = Page{Metadata: Metadata{"page": strconv.Itoa(i + 1)}}
+	}
+	ifd := 0
+	for series, img := range ome.Images {
+		planes := img.planes(ifd)
+		for at, plane := range planes {
+			if at < 0 || at >= len(pages) {
+				continue
+			}
+			meta := pages[at].Metadata
+			if len(ome.Images) > 1 {
+				meta["series"] = strconv.Itoa(series + 1)
+				if img.Name != "" {
+					meta["series"] = img.Name
+				}
+			}
+			px := img.Pixels
+			if px.SizeC > 1 || len(px.Channels) > 0 {
+				meta["channel"] = strconv.Itoa(plane[0] + 1)
+				if plane[0] < len(px.Channels) && px.Channels[plane[0]].Name != "" {
+					meta["channel"] = px.Channels[plane[0]].Name
+				}
+			}
+			if px.SizeZ > 1 {
+				meta["z"] = strconv.Itoa(plane[1] + 1)
+			}
+			if px.SizeT > 1 {
+				meta["t"] = strconv.Itoa(plane[2] + 1)
+			}
+			pages[at].PixelSize = omeMicrons(px.PhysicalSizeX, px.PhysicalSizeXUnit)
+		}
+		ifd += img.planeCount()
+	}
+	return pages, nil
+}
+
+func (d *OmeTiffDecoder) DecodePage(r io.ReaderAt, page int) (image.Image, error) {
+	return (&TiffDecoder{}).DecodePage(r, page)
+}
+
+func (img *omeImage) planeCount() int {
+	px := img.Pixels
+	return atLeastOne(px.SizeC) * atLeastOne(px.SizeZ) * atLeastOne(px.SizeT)
+}
+
+// planes maps the ifds holding the image's planes to the (c, z, t) of the
+// plane. Without TiffData elements the planes are stored in order starting at
+// the first ifd.
+func (img *omeImage) planes(first int) map[int][3]int {
+	px := img.Pixels
+	sizes := map[byte]int{'C': atLeastOne(px.SizeC), 'Z': atLeastOne(px.SizeZ), 'T': atLeastOne(px.SizeT)}
+	order := strings.TrimPrefix(strings.ToUpper(px.DimensionOrder), "XY")
+	if len(order) != 3 {
+		order = "ZCT"
+	}
+	n := img.planeCount()
+	// plane index <-> (c, z, t), the first letter of the order varies fastest
+	coords := func(p int) [3]int {
+		var czt [3]int
+		for i := 0; i < 3; i++ {
+			s := sizes[order[i]]
+			czt[strings.IndexByte("CZT", order[i])] = p % s
+			p /= s
+		}
+		return czt
+	}
+	index := func(czt [3]int) int {
+		p := 0
+		for i := 2; i >= 0; i-- {
+			p = p*sizes[order[i]] + czt[strings.IndexByte("CZT", order[i])]
+		}
+		return p
+	}
+	planes := make(map[int][3]int, n)
+	if len(px.TiffData) == 0 {
+		for p := 0; p < n; p++ {
+			planes[first + p] = coords(p)
+		}
+		return planes
+	}
+	for _, td := range px.TiffData {
+		start := index([3]int{td.FirstC, td.FirstZ, td.FirstT})
+		ifd := first
+		count := n - start
+		if td.IFD != nil {
+			ifd = *td.IFD
+			count = 1
+		}
+		if td.PlaneCount != nil {
+			count = *td.PlaneCount
+		}
+		for k := 0; k < count && start + k < n; k++ {
+			planes[ifd + k] = coords(start + k)
+		}
+	}
+	return planes
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// omeMicrons converts an OME length to microns. OME's default unit is
+// microns.
+func omeMicrons(size float64, unit string) float64 {
+	switch unit {
+	case "", "µm", "um":
+		return size
+	case "nm":
+		return size / 1000
+	case "mm":
+		return size * 1000
+	case "cm":
+		return size * 10000
+	case "m":
+		return size * 1e6
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,80 @@
+package ingest
+
+import "testing"
+
+import (
+	"bytes"
+)
+
+const omeDescription = `<?xml version="1.0" encoding="UTF-8"?>
+<OME xmlns="http://www.openmicroscopy.org/Schemas/OME/2016-06">
+	<Image ID="Image:0" Name="L1">
+		<Pixels ID="Pixels:0" DimensionOrder="XYCZT" Type="uint8"
+			SizeX="4" SizeY="3" SizeC="2" SizeZ="2" SizeT="1"
+			PhysicalSizeX="650" PhysicalSizeXUnit="nm">
+			<Channel ID="Channel:0:0" Name="DAPI"/>
+			<Channel ID="Channel:0:1" Name="FITC"/>
+			<TiffData/>
+		</Pixels>
+	</Image>
+</OME>`
+
+func TestOmeTiff(t *testing.T) {
+	data := multiPageTiff(4, 3, []byte{1, 2, 3, 4}, []string{omeDescription, "", "", ""})
+	r := bytes.NewReader(data)
+	d, err := FindDecoder("L1.ome.tif", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name() != "ome-tiff" {
+		t.Fatal("expected the ome-tiff decoder got", d.Name())
+	}
+	pages, err := d.Pages(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Metadata{
+		{"page": "1", "channel": "DAPI", "z": "1"},
+		{"page": "2", "channel": "FITC", "z": "1"},
+		{"page": "3", "channel": "DAPI", "z": "2"},
+		{"page": "4", "channel": "FITC", "z": "2"},
+	}
+	if len(pages) != len(expect) {
+		t.Fatal("expected", len(expect), "pages got", len(pages))
+	}
+	for i, page := range pages {
+		if !page.Metadata.Equal(expect[i]) {
+			t.Fatal("page", i, "expected", expect[i], "got", page.Metadata)
+		}
+		if page.PixelSize != .65 {
+			t.Fatal("expected a pixel size of .65 got", page.PixelSize)
+		}
+	}
+	img, err := d.DecodePage(r, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := img.At(0, 0).RGBA(); r>>8 != 3 {
+		t.Fatal("decoded the wrong page", r>>8)
+	}
+}
+
+func TestFindDecoder(t *testing.T) {
+	tiff := multiPageTiff(1, 1, []byte{0}, []string{"DAPI"})
+	for _, c := range []struct{data []byte; name string}{
+		{tiff, "tiff"},
+		{[]byte("\x89PNG\r\n\x1a\n"), "image"},
+		{[]byte("\xFF\xD8\xFF\xE0"), "image"},
+	} {
+		d, err := FindDecoder("x", bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Name() != c.name {
+			t.Fatal("expected", c.name, "got", d.Name())
+		}
+	}
+	if _, err := FindDecoder("x.czi", bytes.NewReader([]byte("ZISRAWFILE"))); err == nil {
+		t.Fatal("expected no decoder for a czi")
+	}
+}
@@ -0,0 +1,265 @@
+package ingest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+
+type Projection int
+
+const (
+	NoProjection Projection = iota
+	MaxProjection
+	MeanProjection
+	MinProjection
+)
+
+func ParseProjection(s string) (Projection, error) {
+	switch s {
+	case "", "none":
+		return NoProjection, nil
+	case "max":
+		return MaxProjection, nil
+	case "mean":
+		return MeanProjection, nil
+	case "min":
+		return MinProjection, nil
+	default:
+		return NoProjection, fmt.Errorf("unknown projection '%v' (expected none, max, mean or min)", s)
+	}
+}
+
+func (p Projection) String() string {
+	switch p {
+	case NoProjection:
+		return "none"
+	case MaxProjection:
+		return "max"
+	case MeanProjection:
+		return "mean"
+	case MinProjection:
+		return "min"
+	default:
+		return fmt.Sprintf("<projection %d>", int(p))
+	}
+}
+
+// Project collapses every set of images which share all of their metadata
+// except the variable `on` (eg. the z-slices of a stack) into a single
+// projected image. The projected image has `on` set to the name of the
+// projection. Images which are alone in their stack are left as they are. The
+// synthesized `page` of a multi-page tiff is ignored along with `on`. Stacks
+// which can not be projected are kept as they are. The previews of the
+// projections are written with enc.
+func Project(images []*Image, on string, mode Projection, enc Encoder) []*Image {
+	if mode == NoProjection {
+		return images
+	}
+	stacks := make(map[string][]*Image)
+	keys := make([]string, 0, len(images))
+	for _, img := range images {
+		key := stackKey(img, on)
+		if _, has := stacks[key]; !has {
+			keys = append(keys, key)
+		}
+		stacks[key] = append(stacks[key], img)
+	}
+	projected := make([]*Image, 0, len(keys))
+	for _, key := range keys {
+		stack := stacks[key]
+		if len(stack) == 1 {
+			projected = append(projected, stack[0])
+			continue
+		}
+		img, err := mode.ProjectStack(stack, on, enc)
+		if err != nil {
+			log.Println("WARN", "not projecting the stack of", stack[0].Path, "because", err)
+			projected = append(projected, stack...)
+			continue
+		}
+		projected = append(projected, img)
+	}
+	return projected
+}
+
+func stackKey(img *Image, on string) string {
+	meta := img.Meta()
+	if _, has := meta[on]; !has {
+		// not part of any stack
+		return "\x01" + img.Path
+	}
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		if !stackVariable(img, k, on) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k + "=" + meta[k])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func stackVariable(img *Image, k, on string) bool {
+	return k == on || (k == "page" && img.Page > 0)
+}
+
+// ProjectStack projects a single stack of images into a new image. The
+// originals are streamed a row at a time into a lossless 16 bit png (the
+// Source of the projection) next to the first image of the stack, and the
+// preview is written from it with enc.
+func (p Projection) ProjectStack(stack []*Image, on string, enc Encoder) (*Image, error) {
+	meta := make(Metadata, len(stack[0].Meta()))
+	for k, v := range stack[0].Meta() {
+		if !stackVariable(stack[0], k, on) {
+			meta[k] = v
+		}
+	}
+	meta[on] = p.String()
+	projected := &Image{
+		Path: ProjectionName(stack, p, enc),
+		Metadata: meta,
+		Source: projectionSource(stack, p),
+		PixelSize: originalPixelSize(stack[0]),
+	}
+	if isPreviewExt(".png", enc) {
+		projected.Path = projected.Source
+	}
+	done, err := written(projected.Source)
+	if err == nil && done {
+		done, err = written(projected.Path)
+	}
+	if err != nil {
+		return nil, err
+	} else if done {
+		return projected, nil
+	}
+	out, err := p.project(stack)
+	if err != nil {
+		return nil, err
+	}
+	err = WritePreview(projected.Source, out, &PngEncoder{})
+	if err != nil {
+		os.Remove(projected.Source)
+		return nil, err
+	}
+	if projected.Path == projected.Source {
+		return projected, nil
+	}
+	err = WritePreview(projected.Path, out, enc)
+	if err != nil {
+		os.Remove(projected.Path)
+		return nil, err
+	}
+	return projected, nil
+}
+
+// project streams the originals of the stack, keeping one 32 bit sum per
+// sample of the projection.
+func (p Projection) project(stack []*Image) (image.Image, error) {
+	var size image.Point
+	var ch int
+	var acc []uint32
+	for i, s := range stack {
+		err := s.StreamOriginal(func(src RowSource) error {
+			if i == 0 {
+				size, ch = src.Size(), src.Channels()
+				acc = make([]uint32, size.X*size.Y*ch)
+			} else if src.Size() != size || src.Channels() != ch {
+				return fmt.Errorf("can not project %v (%v with %d channels) onto %v (%v with %d channels), they are different sizes",
+					s.Path, src.Size(), src.Channels(), stack[0].Path, size, ch)
+			}
+			stride := size.X*ch
+			return src.Rows(func(y int, row []uint16) error {
+				cur := acc[y*stride:(y + 1)*stride]
+				for x, v := range row {
+					px := uint32(v)
+					switch {
+					case i == 0:
+						cur[x] = px
+					case p == MaxProjection && px > cur[x]:
+						cur[x] = px
+					case p == MinProjection && px < cur[x]:
+						cur[x] = px
+					case p == MeanProjection:
+						cur[x] += px
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	out := newStreamImage(size.X, size.Y, ch)
+	px := make([]uint16, ch)
+	for i := 0; i < len(acc); i += ch {
+		for c := range px {
+			v := acc[i + c]
+			if p == MeanProjection {
+				v /= uint32(len(stack))
+			}
+			px[c] = uint16(v)
+		}
+		out.set((i/ch) % size.X, (i/ch) / size.X, px)
+	}
+	return out.img, nil
+}
+
+// originalPixelSize undoes the downsampling of a large preview (see
+// Converter.Convert), as the projection is made from the originals.
+func originalPixelSize(img *Image) float64 {
+	if img.Source == "" || img.Source == img.Path {
+		return img.PixelSize
+	}
+	page := img.Page - 1
+	if page < 0 {
+		page = 0
+	}
+	return img.PixelSize / float64(PreviewScale(img.Source, page))
+}
+
+// written is true when a non empty file was already written to path.
+func written(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil && os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return fi.Size() > 0, nil
+}
+
+// ProjectionName is where the preview of the projection of a stack is
+// written. The names of the stack are hashed as a stack can have many images.
+func ProjectionName(stack []*Image, p Projection, enc Encoder) string {
+	return projectionBase(stack, p) + PreviewExt(enc)
+}
+
+// projectionSource is where the lossless projection is written.
+func projectionSource(stack []*Image, p Projection) string {
+	return projectionBase(stack, p) + ".16bit.png"
+}
+
+func projectionBase(stack []*Image, p Projection) string {
+	dir := filepath.Dir(stack[0].Path)
+	h := fnv.New32a()
+	for _, img := range stack {
+		h.Write([]byte(filepath.Base(img.Path)))
+		h.Write([]byte{0})
+	}
+	first := filepath.Base(stack[0].Path)
+	first = strings.TrimSuffix(first, filepath.Ext(first))
+	name := fmt.Sprintf("%v-projection::%v::%08x", p, first, h.Sum32())
+	return filepath.Join(dir, name)
+}
@@ -0,0 +1,83 @@
+package ingest
+
+import "testing"
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func TestProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	images := make([]*Image, 0, 4)
+	for z, v := range []uint8{40, 200, 120} {
+		img := image.NewGray(image.Rect(0, 0, 8, 8))
+		for i := range img.Pix {
+			img.Pix[i] = v
+		}
+		path := filepath.Join(dir, string(rune('a' + z)) + ".jpeg")
+		err := WriteJpeg(path, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, &Image{
+			Path: path,
+			Metadata: Metadata{"region": "L1", "z": string(rune('1' + z))},
+			PixelSize: 0.5,
+		})
+	}
+	images = append(images, &Image{
+		Path: "other",
+		Metadata: Metadata{"region": "L2", "z": "1"},
+	})
+	for _, c := range []struct{mode Projection; expect uint8}{
+		{MaxProjection, 200}, {MinProjection, 40}, {MeanProjection, 120},
+	} {
+		projected := Project(images, "z", c.mode, nil)
+		if len(projected) != 2 {
+			t.Fatal("expected 2 images got", projected)
+		}
+		if projected[0].Meta()["z"] != c.mode.String() || projected[0].Meta()["region"] != "L1" {
+			t.Fatal("unexpected metadata", projected[0].Meta())
+		}
+		if projected[1].Path != "other" {
+			t.Fatal("the lone image should be left alone", projected[1])
+		}
+		img, err := LoadImage(projected[0].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, _, _, _ := img.At(4, 4).RGBA()
+		if d := int(y >> 8) - int(c.expect); d < -2 || d > 2 {
+			t.Fatal(c.mode, "expected", c.expect, "got", color.GrayModel.Convert(img.At(4, 4)))
+		}
+		if projected[0].PixelSize != 0.5 {
+			t.Fatal("expected the pixel size of the stack got", projected[0].PixelSize)
+		}
+		original, err := projected[0].Original()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if original.ColorModel() != color.Gray16Model {
+			t.Fatal(c.mode, "expected a lossless 16 bit projection got", original.ColorModel())
+		}
+	}
+}
+
+func TestProjectKeepsFailedStacks(t *testing.T) {
+	images := []*Image{
+		{Path: "/does/not/exist/z1.png", Metadata: Metadata{"region": "L1", "z": "1"}},
+		{Path: "/does/not/exist/z2.png", Metadata: Metadata{"region": "L1", "z": "2"}},
+	}
+	projected := Project(images, "z", MaxProjection, nil)
+	if len(projected) != 2 || projected[0] != images[0] || projected[1] != images[1] {
+		t.Fatal("expected the stack which could not be read to be kept", projected)
+	}
+}
@@ -0,0 +1,174 @@
+package ingest
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+
+// ScaleBar burns a scale bar into the bottom right corner of an image.
+type ScaleBar struct {
+	// the length of the bar in microns. 0 picks a round length about a fifth
+	// of the width of the image.
+	Length float64
+	// microns per pixel. when set it overrides the pixel size of the images.
+	PixelSize float64
+	// write the length of the bar above it.
+	Label bool
+	// writes the images with the bar.
+	Previews
+}
+
+// ReadPixelSize finds the width in microns of a pixel of the image at path
+// (or of its 1-based page). A sidecar file next to the image named like the
+// image with the extension `.pixel-size` takes precedence over the pixel size
+// recorded in the file (eg. the tiff resolution tags). It returns 0 if the
+// pixel size is unknown.
+func ReadPixelSize(path string, page int) float64 {
+	if size := SidecarPixelSize(path); size > 0 {
+		return size
+	}
+	pages, err := ReadPages(path)
+	if err != nil || len(pages) == 0 {
+		return 0
+	}
+	size := pages[0].PixelSize
+	if page > 0 && page <= len(pages) {
+		size = pages[page-1].PixelSize
+	}
+	if size > 0 {
+		log.Println("WARN", "the pixel size of", path, "is", size, "microns from its resolution tags, write a .pixel-size file or use --pixel-size if it is wrong")
+	}
+	return size
+}
+
+func SidecarPixelSize(path string) float64 {
+	sidecar := strings.TrimSuffix(path, filepath.Ext(path)) + ".pixel-size"
+	bytes, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		return 0
+	}
+	size, err := strconv.ParseFloat(strings.TrimSpace(string(bytes)), 64)
+	if err != nil || size <= 0 {
+		return 0
+	}
+	return size
+}
+
+// Burn writes a copy of img with the scale bar drawn on it. The copy is written
+// next to img so the unmarked image can still be used to make overlays and
+// mosaics. Images with an unknown pixel size are returned as they are.
+func (s *ScaleBar) Burn(img *Image) (*Image, error) {
+	pixelSize := img.PixelSize
+	if s.PixelSize > 0 {
+		pixelSize = s.PixelSize
+	}
+	if pixelSize <= 0 {
+		return img, nil
+	}
+	name := strings.TrimSuffix(img.Path, filepath.Ext(img.Path))
+	label := ""
+	if s.Label {
+		label = "-label"
+	}
+	path := fmt.Sprintf("%v.scalebar-%g-%g%v%v", name, s.Length, pixelSize, label, s.PreviewExt())
+	burned := *img
+	burned.Path = path
+	burned.PixelSize = pixelSize
+	fi, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil && fi.Size() > 0 {
+		return &burned, nil
+	}
+	pix, err := LoadImage(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	err = s.WritePreview(path, s.Draw(pix, pixelSize))
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &burned, nil
+}
+
+// Draw draws the scale bar (in white) onto a copy of img.
+func (s *ScaleBar) Draw(img image.Image, pixelSize float64) *image.NRGBA {
+	out := imaging.Clone(img)
+	b := out.Bounds()
+	length := s.Length
+	if length <= 0 {
+		length = RoundLength(float64(b.Dx()) * pixelSize / 5)
+	}
+	barW := int(length / pixelSize + .5)
+	barH := b.Dy() / 100
+	if barH < 2 {
+		barH = 2
+	}
+	margin := b.Dx() / 40
+	if margin < 2 {
+		margin = 2
+	}
+	bar := image.Rect(b.Max.X - margin - barW, b.Max.Y - margin - barH, b.Max.X - margin, b.Max.Y - margin)
+	draw.Draw(out, bar, image.White, image.ZP, draw.Over)
+	if !s.Label {
+		return out
+	}
+	text := FormatLength(length)
+	face := basicfont.Face7x13
+	label := image.NewNRGBA(image.Rect(0, 0, face.Advance*len(text), face.Height))
+	d := &font.Drawer{
+		Dst: label,
+		Src: image.White,
+		Face: face,
+		Dot: fixed.P(0, face.Ascent),
+	}
+	d.DrawString(text)
+	// the font is tiny, scale it with the bar
+	scale := (barH*3 + face.Height - 1) / face.Height
+	if scale < 1 {
+		scale = 1
+	}
+	big := imaging.Resize(label, label.Bounds().Dx()*scale, label.Bounds().Dy()*scale, imaging.NearestNeighbor)
+	at := image.Pt(bar.Min.X + (bar.Dx() - big.Bounds().Dx())/2, bar.Min.Y - barH - big.Bounds().Dy())
+	draw.Draw(out, big.Bounds().Add(at), big, image.ZP, draw.Over)
+	return out
+}
+
+// RoundLength finds the largest 1, 2 or 5 times a power of 10 which is no
+// longer than max.
+func RoundLength(max float64) float64 {
+	if max <= 0 {
+		return 1
+	}
+	pow := math.Pow(10, math.Floor(math.Log10(max)))
+	for _, m := range []float64{5, 2, 1} {
+		if m*pow <= max {
+			return m*pow
+		}
+	}
+	return pow
+}
+
+func FormatLength(microns float64) string {
+	if microns >= 1000 {
+		return fmt.Sprintf("%g mm", microns/1000)
+	}
+	return fmt.Sprintf("%g um", microns)
+}
@@ -0,0 +1,55 @@
+package ingest
+
+import "testing"
+
+import (
+	"image"
+)
+
+func TestRoundLength(t *testing.T) {
+	for _, c := range []struct{max, expect float64}{
+		{130, 100}, {260, 200}, {999, 500}, {1000, 1000}, {7.5, 5}, {.3, .2},
+	} {
+		if l := RoundLength(c.max); l != c.expect {
+			t.Fatal("RoundLength", c.max, "expected", c.expect, "got", l)
+		}
+	}
+}
+
+func TestScaleBarDraw(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 400, 200))
+	bar := &ScaleBar{Length: 50, Label: true}
+	out := bar.Draw(img, .5)
+	// 50 microns at .5 microns per pixel is 100 pixels, 10 pixels in from
+	// the right and the bottom
+	white := 0
+	y := 200 - 10 - 1
+	for x := 0; x < 400; x++ {
+		if out.NRGBAAt(x, y).R == 255 {
+			white++
+		}
+	}
+	if white != 100 {
+		t.Fatal("expected a 100 pixel bar got", white)
+	}
+	if out.NRGBAAt(389, y).R != 255 || out.NRGBAAt(289, y).R != 0 {
+		t.Fatal("the bar is in the wrong place")
+	}
+}
+
+func TestTiffPixelSize(t *testing.T) {
+	for _, c := range []struct{page TiffPage; expect float64}{
+		{TiffPage{XResolution: 25400, ResolutionUnit: 2}, 1},
+		{TiffPage{XResolution: 20000, ResolutionUnit: 3}, .5},
+		{TiffPage{XResolution: 4, ResolutionUnit: 1, Description: "ImageJ=1.51\nunit=micron\n"}, .25},
+		{TiffPage{XResolution: 4, ResolutionUnit: 1}, 0},
+		{TiffPage{ResolutionUnit: 2}, 0},
+		{TiffPage{XResolution: 72, ResolutionUnit: 2}, 0},
+		{TiffPage{XResolution: 300, ResolutionUnit: 2}, 0},
+		{TiffPage{XResolution: 300, ResolutionUnit: 3}, 10000.0/300},
+	} {
+		if s := c.page.PixelSize(); s != c.expect {
+			t.Fatal(c.page, "expected", c.expect, "got", s)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package ingest
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+
+// RowSource reads a page a row at a time, so pages too large to decode in one
+// go (eg. whole slide scans) can still be previewed.
+type RowSource interface {
+	Size() image.Point
+	// 1 for grayscale, 3 for rgb.
+	Channels() int
+	// the bits per sample of the stored data, 8 or 16. the rows are always
+	// 16 bit, 8 bit samples are scaled up.
+	Depth() int
+	// Rows calls fn with each row, top to bottom. The row holds Channels()
+	// 16 bit samples per pixel and is only valid during the call.
+	Rows(fn func(y int, row []uint16) error) error
+}
+
+// RowDecoder is implemented by decoders which can stream their pages.
+type RowDecoder interface {
+	PageRows(r io.ReaderAt, page int) (RowSource, error)
+}
+
+// ImageRows is a RowSource reading a decoded image.
+func ImageRows(img image.Image) RowSource {
+	return &imageRows{img}
+}
+
+type imageRows struct {
+	img image.Image
+}
+
+func (r *imageRows) Size() image.Point {
+	return r.img.Bounds().Size()
+}
+
+func (r *imageRows) Channels() int {
+	switch r.img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return 1
+	}
+	return 3
+}
+
+func (r *imageRows) Depth() int {
+	switch r.img.ColorModel() {
+	case color.Gray16Model, color.RGBA64Model, color.NRGBA64Model, color.Alpha16Model:
+		return 16
+	}
+	return 8
+}
+
+func (r *imageRows) Rows(fn func(y int, row []uint16) error) error {
+	b := r.img.Bounds()
+	ch := r.Channels()
+	row := make([]uint16, b.Dx()*ch)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := (x - b.Min.X)*ch
+			if ch == 1 {
+				row[i] = color.Gray16Model.Convert(r.img.At(x, y)).(color.Gray16).Y
+				continue
+			}
+			red, green, blue, _ := r.img.At(x, y).RGBA()
+			row[i], row[i+1], row[i+2] = uint16(red), uint16(green), uint16(blue)
+		}
+		if err := fn(y - b.Min.Y, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamOriginal calls fn with the rows of the image as it was before it was
+// converted to a preview (see Original). Pages the decoder can not stream are
+// decoded whole.
+func (i *Image) StreamOriginal(fn func(src RowSource) error) error {
+	path, page := i.Source, 0
+	if path == "" {
+		path = i.Path
+	} else if i.Page > 0 {
+		page = i.Page - 1
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := FindDecoder(path, f)
+	if err != nil {
+		return err
+	}
+	if rd, ok := d.(RowDecoder); ok {
+		if src, err := rd.PageRows(f, page); err == nil {
+			return fn(src)
+		}
+	}
+	img, err := d.DecodePage(f, page)
+	if err != nil {
+		return err
+	}
+	return fn(ImageRows(img))
+}
+
+// Pages with more pixels than LargeImagePixels are streamed and downsampled
+// so the longer side of their preview is at most MaxPreviewSide.
+var (
+	LargeImagePixels = 64 << 20
+	MaxPreviewSide = 4096
+)
+
+// LoadPreview decodes the 0-based page of the image file at path. Large pages
+// (see LargeImagePixels) are downsampled while they are read when the decoder
+// can stream them. scale is the downsampling factor, 1 when the page was
+// decoded at full resolution.
+func LoadPreview(path string, page int) (img image.Image, scale int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	d, err := FindDecoder(path, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	if src := largePage(d, f, page); src != nil {
+		scale = previewScale(src)
+		img, err = Downsample(src, scale)
+		if err != nil {
+			return nil, 0, err
+		}
+		return img, scale, nil
+	}
+	img, err = d.DecodePage(f, page)
+	if err != nil {
+		return nil, 0, err
+	}
+	return img, 1, nil
+}
+
+// PreviewScale is the factor LoadPreview downsamples the page by, without
+// decoding it.
+func PreviewScale(path string, page int) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+	d, err := FindDecoder(path, f)
+	if err != nil {
+		return 1
+	}
+	if src := largePage(d, f, page); src != nil {
+		return previewScale(src)
+	}
+	return 1
+}
+
+func previewScale(src RowSource) int {
+	size := src.Size()
+	side := size.X
+	if size.Y > side {
+		side = size.Y
+	}
+	return (side + MaxPreviewSide - 1) / MaxPreviewSide
+}
+
+// largePage is the RowSource of the page if it is large and can be streamed,
+// else nil.
+func largePage(d Decoder, r io.ReaderAt, page int) RowSource {
+	rd, ok := d.(RowDecoder)
+	if !ok {
+		return nil
+	}
+	src, err := rd.PageRows(r, page)
+	if err != nil {
+		return nil
+	}
+	size := src.Size()
+	if int64(size.X)*int64(size.Y) <= int64(LargeImagePixels) {
+		return nil
+	}
+	return src
+}
+
+// WritePagePyramid writes the pyramid (see WritePyramid) of the 0-based page
+// of the file at path. It is an error if the decoder can not stream the page.
+func WritePagePyramid(path string, page int, dir string, tile int, enc Encoder) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := FindDecoder(path, f)
+	if err != nil {
+		return err
+	}
+	rd, ok := d.(RowDecoder)
+	if !ok {
+		return fmt.Errorf("the %v decoder can not stream pages", d.Name())
+	}
+	src, err := rd.PageRows(f, page)
+	if err != nil {
+		return err
+	}
+	return WritePyramid(src, dir, tile, enc)
+}
+
+// Downsample shrinks the page by factor, averaging each factor x factor block
+// of pixels. Only one row of the output is accumulated at a time. A factor of
+// 1 decodes the page at full resolution.
+func Downsample(src RowSource, factor int) (image.Image, error) {
+	if factor < 1 {
+		return nil, fmt.Errorf("downsampling factor must be at least 1 got %d", factor)
+	}
+	size := src.Size()
+	ch := src.Channels()
+	w := (size.X + factor - 1) / factor
+	h := (size.Y + factor - 1) / factor
+	out := newStreamImage(w, h, ch)
+	acc := make([]uint64, w*ch)
+	err := src.Rows(func(y int, row []uint16) error {
+		for x := 0; x < size.X; x++ {
+			for c := 0; c < ch; c++ {
+				acc[(x/factor)*ch + c] += uint64(row[x*ch + c])
+			}
+		}
+		if (y + 1) % factor != 0 && y != size.Y - 1 {
+			return nil
+		}
+		rows := y % factor + 1
+		px := make([]uint16, ch)
+		for ox := 0; ox < w; ox++ {
+			n := uint64(rows * smaller(factor, size.X - ox*factor))
+			for c := 0; c < ch; c++ {
+				px[c] = uint16(acc[ox*ch + c] / n)
+				acc[ox*ch + c] = 0
+			}
+			out.set(ox, y/factor, px)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.img, nil
+}
+
+// WritePyramid writes the page as a pyramid of tiles for deep zoom viewers.
+// Level 0 is the full resolution page, each level after it is half the size
+// of the one before, down to the level which fits in a single tile. The tile
+// at column x and row y of a level is written to dir/<level>/<x>_<y> (plus
+// PreviewExt) and encoded with enc. Each level holds one row of tiles in
+// memory.
+func WritePyramid(src RowSource, dir string, tile int, enc Encoder) error {
+	if tile < 1 {
+		return fmt.Errorf("tile size must be at least 1 got %d", tile)
+	}
+	top := newPyramidLevel(dir, 0, src.Size(), src.Channels(), tile, enc)
+	err := src.Rows(top.push)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type pyramidLevel struct {
+	dir string
+	level int
+	size image.Point
+	ch int
+	tile int
+	enc Encoder
+	// the rows of the current row of tiles
+	band []uint16
+	// the previous row, waiting to be averaged with the next one
+	half []uint16
+	next *pyramidLevel
+}
+
+func newPyramidLevel(dir string, level int, size image.Point, ch, tile int, enc Encoder) *pyramidLevel {
+	p := &pyramidLevel{
+		dir: dir,
+		level: level,
+		size: size,
+		ch: ch,
+		tile: tile,
+		enc: enc,
+		band: make([]uint16, tile*size.X*ch),
+	}
+	if size.X > tile || size.Y > tile {
+		p.half = make([]uint16, size.X*ch)
+		p.next = newPyramidLevel(dir, level + 1, image.Pt((size.X + 1)/2, (size.Y + 1)/2), ch, tile, enc)
+	}
+	return p
+}
+
+func (p *pyramidLevel) push(y int, row []uint16) error {
+	stride := p.size.X * p.ch
+	copy(p.band[(y % p.tile)*stride:], row)
+	if (y + 1) % p.tile == 0 || y == p.size.Y - 1 {
+		if err := p.writeTiles(y / p.tile, y % p.tile + 1); err != nil {
+			return err
+		}
+	}
+	if p.next == nil {
+		return nil
+	}
+	if y % 2 == 0 && y != p.size.Y - 1 {
+		copy(p.half, row)
+		return nil
+	}
+	above := p.half
+	if y % 2 == 0 {
+		// the last row of an odd height level
+		above = row
+	}
+	down := make([]uint16, p.next.size.X*p.ch)
+	for x := 0; x < p.next.size.X; x++ {
+		right := smaller(2*x + 1, p.size.X - 1)
+		for c := 0; c < p.ch; c++ {
+			sum := uint32(above[2*x*p.ch + c]) + uint32(above[right*p.ch + c]) +
+				uint32(row[2*x*p.ch + c]) + uint32(row[right*p.ch + c])
+			down[x*p.ch + c] = uint16(sum / 4)
+		}
+	}
+	return p.next.push(y / 2, down)
+}
+
+func (p *pyramidLevel) writeTiles(ty, rows int) error {
+	dir := filepath.Join(p.dir, fmt.Sprint(p.level))
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return err
+	}
+	stride := p.size.X * p.ch
+	px := make([]uint16, p.ch)
+	for tx := 0; tx*p.tile < p.size.X; tx++ {
+		cols := smaller(p.tile, p.size.X - tx*p.tile)
+		out := newStreamImage(cols, rows, p.ch)
+		for y := 0; y < rows; y++ {
+			for x := 0; x < cols; x++ {
+				at := y*stride + (tx*p.tile + x)*p.ch
+				copy(px, p.band[at:at + p.ch])
+				out.set(x, y, px)
+			}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%d_%d%v", tx, ty, PreviewExt(p.enc)))
+		if err := WritePreview(path, out.img, p.enc); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	return nil
+}
+
+// streamImage is a Gray16 or RGBA64 image written a pixel at a time.
+type streamImage struct {
+	img image.Image
+	set func(x, y int, px []uint16)
+}
+
+func newStreamImage(w, h, ch int) *streamImage {
+	if ch == 1 {
+		g := image.NewGray16(image.Rect(0, 0, w, h))
+		return &streamImage{g, func(x, y int, px []uint16) {
+			g.SetGray16(x, y, color.Gray16{px[0]})
+		}}
+	}
+	c := image.NewRGBA64(image.Rect(0, 0, w, h))
+	return &streamImage{c, func(x, y int, px []uint16) {
+		c.SetRGBA64(x, y, color.RGBA64{px[0], px[1], px[2], 0xffff})
+	}}
+}
+
+func smaller(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,407 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+)
+
+import (
+	"golang.org/x/image/tiff"
+)
+
+
+const (
+	tiffImageDescription = 270
+	tiffXResolution = 282
+	tiffResolutionUnit = 296
+	tiffTypeASCII = 2
+	tiffTypeShort = 3
+	tiffTypeRational = 5
+)
+
+// TiffPage is one image file directory (IFD) of a tiff.
+type TiffPage struct {
+	Index int
+	Offset int64
+	Description string
+	// pixels per ResolutionUnit, 0 if the page does not say.
+	XResolution float64
+	// 1 no unit, 2 inches, 3 centimeters. tiff defaults to inches.
+	ResolutionUnit int
+	entries map[uint16]tiffEntry
+	// the page is from a BigTIFF
+	big bool
+}
+
+// TiffPages walks the chain of image file directories in a tiff. Each one is
+// a page, which may be a channel, a z-slice or a time point depending on the
+// instrument which wrote it. Both classic tiffs and BigTIFFs (which use 64 bit
+// offsets so they can be larger than 4 GB) are read.
+func TiffPages(r io.ReaderAt) ([]TiffPage, binary.ByteOrder, error) {
+	header := make([]byte, 16)
+	n, err := r.ReadAt(header, 0)
+	if n < 8 {
+		return nil, nil, err
+	}
+	var order binary.ByteOrder
+	switch string(header[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("not a tiff")
+	}
+	var big bool
+	var offset int64
+	switch order.Uint16(header[2:4]) {
+	case 42:
+		offset = int64(order.Uint32(header[4:8]))
+	case 43:
+		if n < 16 || order.Uint16(header[4:6]) != 8 {
+			return nil, nil, fmt.Errorf("bad BigTIFF header")
+		}
+		big = true
+		offset = int64(order.Uint64(header[8:16]))
+	default:
+		return nil, nil, fmt.Errorf("not a tiff")
+	}
+	pages := make([]TiffPage, 0, 1)
+	seen := make(map[int64]bool)
+	for offset != 0 {
+		if seen[offset] {
+			return nil, nil, fmt.Errorf("tiff has a loop in its directories at %d", offset)
+		}
+		seen[offset] = true
+		page, next, err := readTiffPage(r, order, offset, big)
+		if err != nil {
+			return nil, nil, err
+		}
+		page.Index = len(pages)
+		pages = append(pages, page)
+		offset = next
+	}
+	return pages, order, nil
+}
+
+// readTiffPage reads the directory at offset. Classic tiff entries are 12
+// bytes (tag, type, 4 byte count, 4 byte value) and BigTIFF entries are 20
+// (tag, type, 8 byte count, 8 byte value).
+func readTiffPage(r io.ReaderAt, order binary.ByteOrder, offset int64, big bool) (page TiffPage, next int64, err error) {
+	page.Offset = offset
+	page.ResolutionUnit = 2
+	page.big = big
+	countSize, entrySize, offsetSize := int64(2), int64(12), int64(4)
+	if big {
+		countSize, entrySize, offsetSize = 8, 20, 8
+	}
+	buf := make([]byte, countSize)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return page, 0, err
+	}
+	var count int64
+	if big {
+		count = int64(order.Uint64(buf))
+	} else {
+		count = int64(order.Uint16(buf))
+	}
+	if count < 0 || count > 1<<16 {
+		return page, 0, fmt.Errorf("tiff directory at %d has %d entries", offset, count)
+	}
+	entries := make([]byte, count*entrySize + offsetSize)
+	if _, err := r.ReadAt(entries, offset + countSize); err != nil {
+		return page, 0, err
+	}
+	page.entries = make(map[uint16]tiffEntry, count)
+	for i := int64(0); i < count; i++ {
+		e := entries[i*entrySize:(i+1)*entrySize]
+		entry := tiffEntry{typ: order.Uint16(e[2:4])}
+		if big {
+			entry.count = order.Uint64(e[4:12])
+			entry.value = e[12:20]
+		} else {
+			entry.count = uint64(order.Uint32(e[4:8]))
+			entry.value = e[8:12]
+		}
+		page.entries[order.Uint16(e[0:2])] = entry
+	}
+	err = page.readTags(r, order)
+	if err != nil {
+		return page, 0, err
+	}
+	if big {
+		next = int64(order.Uint64(entries[count*entrySize:]))
+	} else {
+		next = int64(order.Uint32(entries[count*entrySize:]))
+	}
+	return page, next, nil
+}
+
+// readTags fills in the fields of the page from its entries.
+func (page *TiffPage) readTags(r io.ReaderAt, order binary.ByteOrder) error {
+	if e, has := page.entries[tiffImageDescription]; has && e.typ == tiffTypeASCII {
+		desc, err := e.bytes(r, order)
+		if err != nil {
+			return err
+		}
+		page.Description = strings.TrimRight(string(desc), "\x00")
+	}
+	if e, has := page.entries[tiffXResolution]; has && e.typ == tiffTypeRational {
+		rat, err := e.bytes(r, order)
+		if err != nil {
+			return err
+		}
+		if den := order.Uint32(rat[4:8]); den != 0 {
+			page.XResolution = float64(order.Uint32(rat[0:4])) / float64(den)
+		}
+	}
+	if e, has := page.entries[tiffResolutionUnit]; has && e.typ == tiffTypeShort {
+		page.ResolutionUnit = int(order.Uint16(e.value[0:2]))
+	}
+	return nil
+}
+
+// tiffEntry is an entry of an image file directory. value is the raw value
+// field of the entry: the value itself when it fits, otherwise the offset of
+// the value.
+type tiffEntry struct {
+	typ uint16
+	count uint64
+	value []byte
+}
+
+func (e tiffEntry) typeSize() int {
+	switch e.typ {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11:
+		return 4
+	case 5, 10, 12, 16, 17, 18:
+		return 8
+	default:
+		return 1
+	}
+}
+
+func (e tiffEntry) bytes(r io.ReaderAt, order binary.ByteOrder) ([]byte, error) {
+	size := uint64(e.typeSize()) * e.count
+	if size <= uint64(len(e.value)) {
+		return e.value[:size], nil
+	}
+	if size > 1<<31 {
+		return nil, fmt.Errorf("tiff entry too large (%d bytes)", size)
+	}
+	var offset int64
+	if len(e.value) == 8 {
+		offset = int64(order.Uint64(e.value))
+	} else {
+		offset = int64(order.Uint32(e.value))
+	}
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// uints reads an entry of unsigned integers (byte, short, long or long8).
+func (e tiffEntry) uints(r io.ReaderAt, order binary.ByteOrder) ([]uint64, error) {
+	buf, err := e.bytes(r, order)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]uint64, e.count)
+	for i := range vals {
+		switch e.typ {
+		case 1:
+			vals[i] = uint64(buf[i])
+		case 3:
+			vals[i] = uint64(order.Uint16(buf[i*2:]))
+		case 4, 13:
+			vals[i] = uint64(order.Uint32(buf[i*4:]))
+		case 16, 18:
+			vals[i] = order.Uint64(buf[i*8:])
+		default:
+			return nil, fmt.Errorf("tiff entry of type %d is not an unsigned integer", e.typ)
+		}
+	}
+	return vals, nil
+}
+
+// DecodeTiffPage decodes a single page of a (possibly multi-page) tiff.
+// BigTIFF pages are read with the strip reader (see TiffLayout) as the tiff
+// package only reads classic tiffs.
+func DecodeTiffPage(r io.ReaderAt, order binary.ByteOrder, page TiffPage) (image.Image, error) {
+	if page.big {
+		l, err := page.Layout(r, order)
+		if err != nil {
+			return nil, err
+		}
+		return Downsample(&tiffRows{TiffLayout: l, r: r}, 1)
+	}
+	pr := &tiffPageReader{r: r}
+	copy(pr.header[:], []byte("II\x2A\x00"))
+	if order == binary.BigEndian {
+		copy(pr.header[:], []byte("MM\x00\x2A"))
+	}
+	order.PutUint32(pr.header[4:8], uint32(page.Offset))
+	return tiff.Decode(pr)
+}
+
+// TiffDecoder reads tiffs, one page per image file directory.
+type TiffDecoder struct{}
+
+func (d *TiffDecoder) Name() string {
+	return "tiff"
+}
+
+func (d *TiffDecoder) Match(path string, r io.ReaderAt) bool {
+	switch string(readHead(r, 4)) {
+	case "II\x2A\x00", "MM\x00\x2A", "II\x2B\x00", "MM\x00\x2B":
+		return true
+	}
+	return false
+}
+
+func (d *TiffDecoder) Pages(r io.ReaderAt) ([]Page, error) {
+	tiffPages, _, err := TiffPages(r)
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]Page, 0, len(tiffPages))
+	for i, meta := range PageMetadata(tiffPages) {
+		p := tiffPages[i]
+		if p.Description == "" {
+			// imagej only describes the first page
+			p.Description = tiffPages[0].Description
+		}
+		pages = append(pages, Page{Metadata: meta, PixelSize: p.PixelSize()})
+	}
+	return pages, nil
+}
+
+func (d *TiffDecoder) DecodePage(r io.ReaderAt, page int) (image.Image, error) {
+	pages, order, err := TiffPages(r)
+	if err != nil {
+		return nil, err
+	}
+	if page < 0 || page >= len(pages) {
+		return nil, fmt.Errorf("no page %d", page + 1)
+	}
+	return DecodeTiffPage(r, order, pages[page])
+}
+
+// tiffPageReader presents the underlying tiff with its header rewritten to
+// point at a different first directory, so the tiff decoder (which only reads
+// the first directory) will decode the chosen page.
+type tiffPageReader struct {
+	r io.ReaderAt
+	header [8]byte
+	off int64
+}
+
+func (p *tiffPageReader) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.r.ReadAt(b, off)
+	for i := off; i < int64(len(p.header)) && i - off < int64(n); i++ {
+		b[i-off] = p.header[i]
+	}
+	return n, err
+}
+
+func (p *tiffPageReader) Read(b []byte) (int, error) {
+	n, err := p.ReadAt(b, p.off)
+	p.off += int64(n)
+	return n, err
+}
+
+// PageMetadata synthesizes metadata for each page of a tiff. Every page gets
+// its 1-based `page` number. ImageJ hyperstacks are split into `channel`, `z`
+// and `t` using the counts in the description of the first page. Otherwise,
+// short one line descriptions are taken to be the name of the `channel`.
+func PageMetadata(pages []TiffPage) []Metadata {
+	metas := make([]Metadata, 0, len(pages))
+	var imagej map[string]int
+	if len(pages) > 0 {
+		imagej = imagejCounts(pages[0].Description)
+	}
+	for _, page := range pages {
+		meta := Metadata{"page": strconv.Itoa(page.Index + 1)}
+		if imagej != nil {
+			c, z := imagej["channels"], imagej["slices"]
+			i := page.Index
+			if c > 1 {
+				meta["channel"] = strconv.Itoa(i % c + 1)
+				i /= c
+			}
+			if z > 1 {
+				meta["z"] = strconv.Itoa(i % z + 1)
+				i /= z
+			}
+			if imagej["frames"] > 1 {
+				meta["t"] = strconv.Itoa(i + 1)
+			}
+		} else if name := channelName(page.Description); name != "" {
+			meta["channel"] = name
+		}
+		metas = append(metas, meta)
+	}
+	return metas
+}
+
+func imagejCounts(desc string) map[string]int {
+	if !strings.HasPrefix(desc, "ImageJ=") {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, line := range strings.Split(desc, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if n, err := strconv.Atoi(kv[1]); err == nil {
+			counts[kv[0]] = n
+		}
+	}
+	return counts
+}
+
+func channelName(desc string) string {
+	desc = strings.TrimSpace(desc)
+	if desc == "" || len(desc) > 64 || strings.ContainsAny(desc, "\n<=") {
+		return ""
+	}
+	return desc
+}
+
+// PixelSize is the width of a pixel of the page in microns, or 0 if the page
+// does not record its resolution. ImageJ records microns with no resolution
+// unit and says so in its description. The usual screen and print
+// resolutions in inches (72, 96 and 300 dpi) are what writers put in when
+// they do not know the resolution, so they count as unknown too.
+func (p TiffPage) PixelSize() float64 {
+	if p.XResolution <= 0 {
+		return 0
+	}
+	switch p.ResolutionUnit {
+	case 2:
+		switch p.XResolution {
+		case 72, 96, 300:
+			return 0
+		}
+		return 25400 / p.XResolution
+	case 3:
+		return 10000 / p.XResolution
+	}
+	for _, unit := range []string{"unit=micron", "unit=um", "unit=\\u00B5m"} {
+		if strings.Contains(p.Description, unit + "\n") {
+			return 1 / p.XResolution
+		}
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package ingest
+
+import "testing"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// multiPageTiff writes an uncompressed 8-bit grayscale tiff with one page per
+// entry in pages. Every page is filled with its value.
+func multiPageTiff(w, h int, pages []byte, descriptions []string) []byte {
+	buf := new(bytes.Buffer)
+	order := binary.LittleEndian
+	buf.WriteString("II\x2A\x00")
+	binary.Write(buf, order, uint32(8))
+	for i, value := range pages {
+		desc := []byte(descriptions[i] + "\x00")
+		ifd := int64(buf.Len())
+		entries := 9
+		ifdSize := int64(2 + entries*12 + 4)
+		descAt := ifd + ifdSize
+		pixAt := descAt + int64(len(desc))
+		next := uint32(0)
+		if i + 1 < len(pages) {
+			next = uint32(pixAt + int64(w*h))
+		}
+		entry := func(tag, typ uint16, count, value uint32) {
+			binary.Write(buf, order, tag)
+			binary.Write(buf, order, typ)
+			binary.Write(buf, order, count)
+			if typ == 3 && count == 1 {
+				binary.Write(buf, order, uint16(value))
+				binary.Write(buf, order, uint16(0))
+			} else {
+				binary.Write(buf, order, value)
+			}
+		}
+		binary.Write(buf, order, uint16(entries))
+		entry(256, 3, 1, uint32(w))
+		entry(257, 3, 1, uint32(h))
+		entry(258, 3, 1, 8)
+		entry(259, 3, 1, 1)
+		entry(262, 3, 1, 1)
+		entry(270, 2, uint32(len(desc)), uint32(descAt))
+		entry(273, 4, 1, uint32(pixAt))
+		entry(278, 3, 1, uint32(h))
+		entry(279, 4, 1, uint32(w*h))
+		binary.Write(buf, order, next)
+		buf.Write(desc)
+		buf.Write(bytes.Repeat([]byte{value}, w*h))
+	}
+	return buf.Bytes()
+}
+
+func TestTiffPages(t *testing.T) {
+	data := multiPageTiff(4, 3, []byte{10, 20, 30}, []string{"DAPI", "FITC", "TRITC"})
+	r := bytes.NewReader(data)
+	pages, order, err := TiffPages(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 3 {
+		t.Fatal("expected 3 pages got", len(pages))
+	}
+	for i, value := range []uint8{10, 20, 30} {
+		img, err := DecodeTiffPage(r, order, pages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 4, 3) {
+			t.Fatal("unexpected bounds", img.Bounds())
+		}
+		if g := img.(*image.Gray).GrayAt(1, 1).Y; g != value {
+			t.Fatal("page", i, "expected", value, "got", g)
+		}
+	}
+	metas := PageMetadata(pages)
+	for i, name := range []string{"DAPI", "FITC", "TRITC"} {
+		if metas[i]["channel"] != name {
+			t.Fatal("expected channel", name, "got", metas[i])
+		}
+	}
+	if metas[2]["page"] != "3" {
+		t.Fatal("expected page 3 got", metas[2])
+	}
+}
+
+func TestImageJPageMetadata(t *testing.T) {
+	desc := "ImageJ=1.51\nimages=6\nchannels=2\nslices=3\nhyperstack=true\n"
+	pages := make([]TiffPage, 6)
+	for i := range pages {
+		pages[i].Index = i
+	}
+	pages[0].Description = desc
+	metas := PageMetadata(pages)
+	expect := [][2]string{{"1", "1"}, {"2", "1"}, {"1", "2"}, {"2", "2"}, {"1", "3"}, {"2", "3"}}
+	for i, e := range expect {
+		if metas[i]["channel"] != e[0] || metas[i]["z"] != e[1] {
+			t.Fatal("page", i, "expected channel/z", e, "got", metas[i])
+		}
+	}
+}
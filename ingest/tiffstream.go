@@ -0,0 +1,353 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+import (
+	"golang.org/x/image/tiff/lzw"
+)
+
+
+const (
+	tiffImageWidth = 256
+	tiffImageLength = 257
+	tiffBitsPerSample = 258
+	tiffCompression = 259
+	tiffPhotometric = 262
+	tiffStripOffsets = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig = 284
+	tiffPredictor = 317
+	tiffTileWidth = 322
+	tiffTileLength = 323
+	tiffTileOffsets = 324
+	tiffTileByteCounts = 325
+)
+
+// TiffLayout describes how the pixels of a tiff page are stored: in strips of
+// full width rows or in tiles. Only one strip (or one row of tiles) needs to
+// be decompressed at a time, so a page can be read without holding all of it
+// in memory.
+type TiffLayout struct {
+	Width, Height int
+	BitsPerSample int
+	SamplesPerPixel int
+	// 1 none, 5 LZW, 8 (or 32946) deflate, 32773 packbits.
+	Compression int
+	// 1 none, 2 horizontal differencing.
+	Predictor int
+	// 0 white is zero, 1 black is zero, 2 RGB.
+	Photometric int
+	// RowsPerStrip is 0 for tiled pages.
+	RowsPerStrip int
+	TileWidth, TileHeight int
+	// the offsets and sizes of the strips (or tiles).
+	Offsets []uint64
+	Counts []uint64
+	order binary.ByteOrder
+}
+
+// Layout reads the layout of the page from its tags.
+func (p TiffPage) Layout(r io.ReaderAt, order binary.ByteOrder) (*TiffLayout, error) {
+	l := &TiffLayout{order: order}
+	ints := []struct {
+		tag uint16
+		to *int
+		def uint64
+	}{
+		{tiffImageWidth, &l.Width, 0},
+		{tiffImageLength, &l.Height, 0},
+		{tiffBitsPerSample, &l.BitsPerSample, 1},
+		{tiffSamplesPerPixel, &l.SamplesPerPixel, 1},
+		{tiffCompression, &l.Compression, 1},
+		{tiffPredictor, &l.Predictor, 1},
+		{tiffPhotometric, &l.Photometric, 1},
+		{tiffRowsPerStrip, &l.RowsPerStrip, 0},
+		{tiffTileWidth, &l.TileWidth, 0},
+		{tiffTileLength, &l.TileHeight, 0},
+	}
+	for _, i := range ints {
+		v, err := p.uint(r, order, i.tag, i.def)
+		if err != nil {
+			return nil, err
+		}
+		*i.to = int(v)
+	}
+	planar, err := p.uint(r, order, tiffPlanarConfig, 1)
+	if err != nil {
+		return nil, err
+	}
+	offsets, counts := uint16(tiffStripOffsets), uint16(tiffStripByteCounts)
+	if l.TileWidth > 0 {
+		offsets, counts = tiffTileOffsets, tiffTileByteCounts
+		l.RowsPerStrip = 0
+	} else if l.RowsPerStrip <= 0 || l.RowsPerStrip > l.Height {
+		l.RowsPerStrip = l.Height
+	}
+	for tag, to := range map[uint16]*[]uint64{offsets: &l.Offsets, counts: &l.Counts} {
+		e, has := p.entries[tag]
+		if !has {
+			return nil, fmt.Errorf("tiff page %d has no strip or tile offsets", p.Index + 1)
+		}
+		*to, err = e.uints(r, order)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case l.Width <= 0 || l.Height <= 0:
+		return nil, fmt.Errorf("tiff page %d is empty", p.Index + 1)
+	case l.BitsPerSample != 8 && l.BitsPerSample != 16:
+		return nil, fmt.Errorf("%d bit tiffs are not supported", l.BitsPerSample)
+	case planar != 1:
+		return nil, fmt.Errorf("planar tiffs are not supported")
+	case l.Photometric > 2:
+		return nil, fmt.Errorf("tiff photometric interpretation %d is not supported", l.Photometric)
+	case l.Photometric == 2 && l.SamplesPerPixel < 3:
+		return nil, fmt.Errorf("rgb tiff with %d samples per pixel", l.SamplesPerPixel)
+	case len(l.Offsets) != len(l.Counts) || len(l.Offsets) < l.chunks():
+		return nil, fmt.Errorf("tiff page %d is missing strips or tiles", p.Index + 1)
+	}
+	switch l.Compression {
+	case 1, 5, 8, 32946, 32773:
+	default:
+		return nil, fmt.Errorf("tiff compression %d is not supported", l.Compression)
+	}
+	return l, nil
+}
+
+// uint reads the first value of an integer tag.
+func (p TiffPage) uint(r io.ReaderAt, order binary.ByteOrder, tag uint16, def uint64) (uint64, error) {
+	e, has := p.entries[tag]
+	if !has || e.count == 0 {
+		return def, nil
+	}
+	vals, err := e.uints(r, order)
+	if err != nil {
+		return 0, err
+	}
+	return vals[0], nil
+}
+
+func (l *TiffLayout) Size() image.Point {
+	return image.Pt(l.Width, l.Height)
+}
+
+// Channels is 3 for rgb pages and 1 for grayscale pages. Extra samples (eg.
+// alpha) are dropped.
+func (l *TiffLayout) Channels() int {
+	if l.Photometric == 2 {
+		return 3
+	}
+	return 1
+}
+
+// Depth is the bits per sample of the page, 8 or 16.
+func (l *TiffLayout) Depth() int {
+	return l.BitsPerSample
+}
+
+func (l *TiffLayout) chunks() int {
+	if l.TileWidth > 0 {
+		return l.tilesAcross() * ((l.Height + l.TileHeight - 1) / l.TileHeight)
+	}
+	return (l.Height + l.RowsPerStrip - 1) / l.RowsPerStrip
+}
+
+func (l *TiffLayout) tilesAcross() int {
+	return (l.Width + l.TileWidth - 1) / l.TileWidth
+}
+
+func (l *TiffLayout) pixelBytes() int {
+	return l.SamplesPerPixel * l.BitsPerSample / 8
+}
+
+// Rows calls fn with each row of the page, top to bottom. The row holds
+// Channels() 16 bit samples per pixel and is reused between calls.
+func (l *TiffLayout) Rows(r io.ReaderAt, fn func(y int, row []uint16) error) error {
+	pb := l.pixelBytes()
+	stride := l.Width * pb
+	row := make([]uint16, l.Width * l.Channels())
+	emit := func(band []byte, y0, rows int) error {
+		for k := 0; k < rows; k++ {
+			l.samples(band[k*stride:(k+1)*stride], row)
+			if err := fn(y0 + k, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if l.TileWidth == 0 {
+		for i := 0; i < l.chunks(); i++ {
+			y0 := i * l.RowsPerStrip
+			rows := smaller(l.RowsPerStrip, l.Height - y0)
+			strip, err := l.chunk(r, i, l.Width, rows)
+			if err != nil {
+				return err
+			}
+			if err := emit(strip, y0, rows); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw, th := l.TileWidth, l.TileHeight
+	across := l.tilesAcross()
+	band := make([]byte, th * stride)
+	for y0 := 0; y0 < l.Height; y0 += th {
+		for tx := 0; tx < across; tx++ {
+			tile, err := l.chunk(r, (y0/th)*across + tx, tw, th)
+			if err != nil {
+				return err
+			}
+			cols := smaller(tw, l.Width - tx*tw) * pb
+			for k := 0; k < th; k++ {
+				copy(band[k*stride + tx*tw*pb:], tile[k*tw*pb:k*tw*pb + cols])
+			}
+		}
+		if err := emit(band, y0, smaller(th, l.Height - y0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// samples converts a row of stored pixels to 16 bit channels.
+func (l *TiffLayout) samples(from []byte, to []uint16) {
+	ch := l.Channels()
+	spp := l.SamplesPerPixel
+	for x := 0; x < l.Width; x++ {
+		for c := 0; c < ch; c++ {
+			i := x*spp + c
+			var v uint16
+			if l.BitsPerSample == 8 {
+				v = uint16(from[i]) * 0x101
+			} else {
+				v = l.order.Uint16(from[i*2:])
+			}
+			if l.Photometric == 0 {
+				v = 0xffff - v
+			}
+			to[x*ch + c] = v
+		}
+	}
+}
+
+// chunk reads and decompresses the i'th strip (or tile) which holds rows rows
+// of width pixels.
+func (l *TiffLayout) chunk(r io.ReaderAt, i, width, rows int) ([]byte, error) {
+	raw := make([]byte, l.Counts[i])
+	if _, err := r.ReadAt(raw, int64(l.Offsets[i])); err != nil {
+		return nil, err
+	}
+	var buf []byte
+	var err error
+	switch l.Compression {
+	case 1:
+		buf = raw
+	case 5:
+		lr := lzw.NewReader(bytes.NewReader(raw), lzw.MSB, 8)
+		buf, err = ioutil.ReadAll(lr)
+		lr.Close()
+	case 8, 32946:
+		var zr io.ReadCloser
+		zr, err = zlib.NewReader(bytes.NewReader(raw))
+		if err == nil {
+			buf, err = ioutil.ReadAll(zr)
+			zr.Close()
+		}
+	case 32773:
+		buf, err = unpackBits(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress tiff strip %d: %v", i, err)
+	}
+	stride := width * l.pixelBytes()
+	if len(buf) < rows*stride {
+		return nil, fmt.Errorf("tiff strip %d is short, %d of %d bytes", i, len(buf), rows*stride)
+	}
+	if l.Predictor == 2 {
+		l.undoPredictor(buf[:rows*stride], stride)
+	}
+	return buf, nil
+}
+
+// undoPredictor reverses horizontal differencing: each sample is stored as
+// the difference from the same sample of the pixel to its left.
+func (l *TiffLayout) undoPredictor(buf []byte, stride int) {
+	spp := l.SamplesPerPixel
+	for y := 0; y + stride <= len(buf); y += stride {
+		row := buf[y:y + stride]
+		if l.BitsPerSample == 8 {
+			for i := spp; i < len(row); i++ {
+				row[i] += row[i-spp]
+			}
+			continue
+		}
+		for i := spp*2; i + 1 < len(row); i += 2 {
+			v := l.order.Uint16(row[i:]) + l.order.Uint16(row[i-spp*2:])
+			l.order.PutUint16(row[i:], v)
+		}
+	}
+}
+
+func unpackBits(raw []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(raw); {
+		n := int(int8(raw[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i + n + 1 > len(raw) {
+				return nil, fmt.Errorf("packbits literal runs past the end")
+			}
+			out = append(out, raw[i:i + n + 1]...)
+			i += n + 1
+		case n > -128:
+			if i >= len(raw) {
+				return nil, fmt.Errorf("packbits run past the end")
+			}
+			out = append(out, bytes.Repeat(raw[i:i+1], 1 - n)...)
+			i++
+		}
+	}
+	return out, nil
+}
+
+// tiffRows is a RowSource reading one page of a tiff.
+type tiffRows struct {
+	*TiffLayout
+	r io.ReaderAt
+}
+
+func (t *tiffRows) Rows(fn func(y int, row []uint16) error) error {
+	return t.TiffLayout.Rows(t.r, fn)
+}
+
+func (d *TiffDecoder) PageRows(r io.ReaderAt, page int) (RowSource, error) {
+	pages, order, err := TiffPages(r)
+	if err != nil {
+		return nil, err
+	}
+	if page < 0 || page >= len(pages) {
+		return nil, fmt.Errorf("no page %d", page + 1)
+	}
+	l, err := pages[page].Layout(r, order)
+	if err != nil {
+		return nil, err
+	}
+	return &tiffRows{TiffLayout: l, r: r}, nil
+}
+
+func (d *OmeTiffDecoder) PageRows(r io.ReaderAt, page int) (RowSource, error) {
+	return (&TiffDecoder{}).PageRows(r, page)
+}
@@ -0,0 +1,343 @@
+package ingest
+
+import "testing"
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type tiffTag struct {
+	tag, typ uint16
+	values []uint32
+}
+
+// writeTiff writes a single page tiff (or BigTIFF) with the given tags (which
+// may only be shorts and longs) followed by the chunks of pixel data. The
+// offsets tag (273 or 324) is filled in to point at the chunks.
+func writeTiff(tags []tiffTag, offsetsTag uint16, chunks [][]byte, big bool) []byte {
+	order := binary.LittleEndian
+	sort.Slice(tags, func(i, j int) bool { return tags[i].tag < tags[j].tag })
+	headerSize, ifdSize, valueSize := 8, 2 + len(tags)*12 + 4, 4
+	if big {
+		headerSize, ifdSize, valueSize = 16, 8 + len(tags)*20 + 8, 8
+	}
+	extra := new(bytes.Buffer)
+	extraAt := headerSize + ifdSize
+	arrays := 0
+	for _, t := range tags {
+		if size := len(t.values) * 2 * int(t.typ - 2); size > valueSize {
+			arrays += size
+		}
+	}
+	pixAt := extraAt + arrays
+	at := uint32(pixAt)
+	for i, t := range tags {
+		if t.tag == offsetsTag {
+			tags[i].values = nil
+			for _, c := range chunks {
+				tags[i].values = append(tags[i].values, at)
+				at += uint32(len(c))
+			}
+		}
+	}
+	buf := new(bytes.Buffer)
+	if big {
+		buf.WriteString("II\x2B\x00")
+		binary.Write(buf, order, uint16(8))
+		binary.Write(buf, order, uint16(0))
+		binary.Write(buf, order, uint64(16))
+		binary.Write(buf, order, uint64(len(tags)))
+	} else {
+		buf.WriteString("II\x2A\x00")
+		binary.Write(buf, order, uint32(8))
+		binary.Write(buf, order, uint16(len(tags)))
+	}
+	for _, t := range tags {
+		binary.Write(buf, order, t.tag)
+		binary.Write(buf, order, t.typ)
+		if big {
+			binary.Write(buf, order, uint64(len(t.values)))
+		} else {
+			binary.Write(buf, order, uint32(len(t.values)))
+		}
+		val := make([]byte, valueSize)
+		data := new(bytes.Buffer)
+		for _, v := range t.values {
+			if t.typ == 3 {
+				binary.Write(data, order, uint16(v))
+			} else {
+				binary.Write(data, order, v)
+			}
+		}
+		if data.Len() <= valueSize {
+			copy(val, data.Bytes())
+		} else if big {
+			order.PutUint64(val, uint64(extraAt + extra.Len()))
+			extra.Write(data.Bytes())
+		} else {
+			order.PutUint32(val, uint32(extraAt + extra.Len()))
+			extra.Write(data.Bytes())
+		}
+		buf.Write(val)
+	}
+	buf.Write(make([]byte, valueSize))
+	buf.Write(extra.Bytes())
+	for buf.Len() < pixAt {
+		buf.WriteByte(0)
+	}
+	for _, c := range chunks {
+		buf.Write(c)
+	}
+	return buf.Bytes()
+}
+
+func deflate(b []byte) []byte {
+	buf := new(bytes.Buffer)
+	w := zlib.NewWriter(buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+// gradient is a w x h grayscale raster where each pixel is x + 10*y.
+func gradient(w, h int) []byte {
+	pix := make([]byte, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			pix[y*w + x] = byte(x + 10*y)
+		}
+	}
+	return pix
+}
+
+// stripTiff stores the gradient in deflated strips of 3 rows with
+// horizontal differencing.
+func stripTiff(w, h int, big bool) []byte {
+	pix := gradient(w, h)
+	var chunks [][]byte
+	var counts []uint32
+	for y := 0; y < h; y += 3 {
+		end := y + 3
+		if end > h {
+			end = h
+		}
+		strip := append([]byte{}, pix[y*w:end*w]...)
+		for r := 0; r < end - y; r++ {
+			row := strip[r*w:(r+1)*w]
+			for x := len(row) - 1; x > 0; x-- {
+				row[x] -= row[x-1]
+			}
+		}
+		chunks = append(chunks, deflate(strip))
+		counts = append(counts, uint32(len(chunks[len(chunks)-1])))
+	}
+	tags := []tiffTag{
+		{256, 3, []uint32{uint32(w)}},
+		{257, 3, []uint32{uint32(h)}},
+		{258, 3, []uint32{8}},
+		{259, 3, []uint32{8}},
+		{262, 3, []uint32{1}},
+		{273, 4, make([]uint32, len(chunks))},
+		{277, 3, []uint32{1}},
+		{278, 3, []uint32{3}},
+		{279, 4, counts},
+		{317, 3, []uint32{2}},
+	}
+	return writeTiff(tags, 273, chunks, big)
+}
+
+// tiledTiff stores the gradient in uncompressed tiles of tile x tile.
+func tiledTiff(w, h, tile int, big bool) []byte {
+	pix := gradient(w, h)
+	var chunks [][]byte
+	var counts []uint32
+	for ty := 0; ty < h; ty += tile {
+		for tx := 0; tx < w; tx += tile {
+			c := make([]byte, tile*tile)
+			for y := 0; y < tile && ty + y < h; y++ {
+				for x := 0; x < tile && tx + x < w; x++ {
+					c[y*tile + x] = pix[(ty + y)*w + tx + x]
+				}
+			}
+			chunks = append(chunks, c)
+			counts = append(counts, uint32(len(c)))
+		}
+	}
+	tags := []tiffTag{
+		{256, 3, []uint32{uint32(w)}},
+		{257, 3, []uint32{uint32(h)}},
+		{258, 3, []uint32{8}},
+		{259, 3, []uint32{1}},
+		{262, 3, []uint32{1}},
+		{277, 3, []uint32{1}},
+		{322, 3, []uint32{uint32(tile)}},
+		{323, 3, []uint32{uint32(tile)}},
+		{324, 4, make([]uint32, len(chunks))},
+		{325, 4, counts},
+	}
+	return writeTiff(tags, 324, chunks, big)
+}
+
+func tiffRowSource(t *testing.T, data []byte) RowSource {
+	src, err := (&TiffDecoder{}).PageRows(bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestTiffRows(t *testing.T) {
+	w, h := 10, 7
+	pix := gradient(w, h)
+	for name, data := range map[string][]byte{
+		"strips": stripTiff(w, h, false),
+		"tiles": tiledTiff(w, h, 4, false),
+		"big strips": stripTiff(w, h, true),
+		"big tiles": tiledTiff(w, h, 4, true),
+	} {
+		src := tiffRowSource(t, data)
+		if src.Size() != image.Pt(w, h) || src.Channels() != 1 {
+			t.Fatal(name, "unexpected size", src.Size(), "or channels", src.Channels())
+		}
+		seen := 0
+		err := src.Rows(func(y int, row []uint16) error {
+			if y != seen {
+				t.Fatal(name, "expected row", seen, "got", y)
+			}
+			seen++
+			for x := 0; x < w; x++ {
+				if row[x] != uint16(pix[y*w + x])*0x101 {
+					t.Fatal(name, "at", x, y, "expected", pix[y*w + x], "got", row[x] >> 8)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if seen != h {
+			t.Fatal(name, "expected", h, "rows got", seen)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	img, err := Downsample(tiffRowSource(t, tiledTiff(10, 7, 4, false)), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := img.(*image.Gray16)
+	if g.Bounds() != image.Rect(0, 0, 3, 2) {
+		t.Fatal("unexpected bounds", g.Bounds())
+	}
+	// mean of x in [0, 4) and y in [0, 4) is 1.5 + 15
+	if v := g.Gray16At(0, 0).Y >> 8; v != 16 {
+		t.Fatal("expected 16 got", v)
+	}
+	// the bottom right block is x in [8, 10) and y in [4, 7)
+	if v := g.Gray16At(2, 1).Y >> 8; v != 58 {
+		t.Fatal("expected 58 got", v)
+	}
+}
+
+func TestWritePyramid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pyramid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = WritePyramid(tiffRowSource(t, stripTiff(10, 7, false)), dir, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10x7 -> 5x4 -> 3x2
+	expected := map[string]image.Point{
+		"0/0_0": {4, 4}, "0/1_0": {4, 4}, "0/2_0": {2, 4},
+		"0/0_1": {4, 3}, "0/1_1": {4, 3}, "0/2_1": {2, 3},
+		"1/0_0": {4, 4}, "1/1_0": {1, 4},
+		"2/0_0": {3, 2},
+	}
+	for name, size := range expected {
+		img, err := LoadImage(filepath.Join(dir, name + PreviewExt(nil)))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if img.Bounds().Size() != size {
+			t.Fatal(name, "expected", size, "got", img.Bounds().Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "3")); !os.IsNotExist(err) {
+		t.Fatal("expected no level 3")
+	}
+}
+
+func TestLoadPreviewDownsamples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "big.tif")
+	err = ioutil.WriteFile(path, tiledTiff(40, 28, 16, false), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(large, side int) {
+		LargeImagePixels, MaxPreviewSide = large, side
+	}(LargeImagePixels, MaxPreviewSide)
+	LargeImagePixels, MaxPreviewSide = 1000, 20
+	img, scale, err := LoadPreview(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scale != 2 || img.Bounds() != image.Rect(0, 0, 20, 14) {
+		t.Fatal("expected a 20x14 preview at scale 2 got", img.Bounds(), scale)
+	}
+	LargeImagePixels = 2000
+	img, scale, err = LoadPreview(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scale != 1 || img.Bounds() != image.Rect(0, 0, 40, 28) {
+		t.Fatal("expected the full page got", img.Bounds(), scale)
+	}
+}
+
+func TestBigTiff(t *testing.T) {
+	w, h := 10, 7
+	pix := gradient(w, h)
+	for name, data := range map[string][]byte{"strips": stripTiff(w, h, true), "tiles": tiledTiff(w, h, 4, true)} {
+		r := bytes.NewReader(data)
+		d, err := FindDecoder("big.tif", r)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		pages, err := d.Pages(r)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(pages) != 1 {
+			t.Fatal(name, "expected 1 page got", len(pages))
+		}
+		img, err := d.DecodePage(r, 0)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if img.Bounds() != image.Rect(0, 0, w, h) {
+			t.Fatal(name, "unexpected bounds", img.Bounds())
+		}
+		for _, at := range []image.Point{{0, 0}, {9, 0}, {3, 4}, {9, 6}} {
+			y, _, _, _ := img.At(at.X, at.Y).RGBA()
+			if uint8(y >> 8) != pix[at.Y*w + at.X] {
+				t.Fatal(name, "at", at, "expected", pix[at.Y*w + at.X], "got", y >> 8)
+			}
+		}
+	}
+}
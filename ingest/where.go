@@ -0,0 +1,343 @@
+package ingest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+
+/*
+The grammar of filter expressions
+
+Where -> Or ;
+
+Or -> And OR Or
+    | And
+    ;
+
+And -> Not AND And
+     | Not
+     ;
+
+Not -> NOT Not
+     | Term
+     ;
+
+Term -> LPAREN Or RPAREN
+      | NAME IN LPAREN Values RPAREN
+      | NAME OP VALUE
+      ;
+
+Values -> VALUE COMMA Values
+        | VALUE
+        ;
+
+OP is one of = != ~ !~ < <= > >=. ~ matches a regular expression and the
+others compare numbers. Names and values are either bare words or quoted
+with ' or ".
+*/
+
+// Where is a filter on the metadata of images, eg.
+//
+//	subject in (rat-1, rat-2) and region = L1 and z <= 10
+type Where interface {
+	Match(meta Metadata) bool
+	String() string
+}
+
+// ParseWhere parses a filter expression (see the grammar above).
+func ParseWhere(s string) (Where, error) {
+	tokens, err := whereTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &whereParser{tokens: tokens}
+	w, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%v' in '%v'", p.tokens[p.i].text, s)
+	}
+	return w, nil
+}
+
+// FilterImages keeps the images whose metadata matches where.
+func FilterImages(images []*Image, where Where) []*Image {
+	kept := make([]*Image, 0, len(images))
+	for _, img := range images {
+		if where.Match(img.Meta()) {
+			kept = append(kept, img)
+		}
+	}
+	return kept
+}
+
+type whereToken struct {
+	text string
+	// quoted tokens are always values, never keywords or operators.
+	quoted bool
+}
+
+func whereTokens(s string) ([]whereToken, error) {
+	var tokens []whereToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, whereToken{text: s[i:i+1]})
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in '%v'", s)
+			}
+			tokens = append(tokens, whereToken{text: s[i+1:i+1+end], quoted: true})
+			i += end + 2
+		case strings.IndexByte("=!~<>", c) >= 0:
+			j := i + 1
+			for j < len(s) && strings.IndexByte("=~", s[j]) >= 0 && j - i < 2 {
+				j++
+			}
+			tokens = append(tokens, whereToken{text: s[i:j]})
+			i = j
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\n(),'\"=!~<>", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, whereToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type whereParser struct {
+	tokens []whereToken
+	i int
+}
+
+// keyword consumes the next token if it is the (unquoted) word.
+func (p *whereParser) keyword(word string) bool {
+	if p.i < len(p.tokens) && !p.tokens[p.i].quoted && p.tokens[p.i].text == word {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *whereParser) value() (string, error) {
+	if p.i >= len(p.tokens) {
+		return "", fmt.Errorf("ran off the end of the filter, expected a value")
+	}
+	t := p.tokens[p.i]
+	if !t.quoted && strings.IndexByte("(),=!~<>", t.text[0]) >= 0 {
+		return "", fmt.Errorf("expected a value got '%v'", t.text)
+	}
+	p.i++
+	return t.text, nil
+}
+
+func (p *whereParser) or() (Where, error) {
+	a, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	if !p.keyword("or") {
+		return a, nil
+	}
+	b, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	return &whereOr{a, b}, nil
+}
+
+func (p *whereParser) and() (Where, error) {
+	a, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	if !p.keyword("and") {
+		return a, nil
+	}
+	b, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	return &whereAnd{a, b}, nil
+}
+
+func (p *whereParser) not() (Where, error) {
+	if p.keyword("not") {
+		w, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &whereNot{w}, nil
+	}
+	return p.term()
+}
+
+func (p *whereParser) term() (Where, error) {
+	if p.keyword("(") {
+		w, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("expected ')' after '%v'", w)
+		}
+		return w, nil
+	}
+	name, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if p.keyword("in") {
+		if !p.keyword("(") {
+			return nil, fmt.Errorf("expected '(' after '%v in'", name)
+		}
+		in := &whereIn{name: name}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			in.values = append(in.values, v)
+			if p.keyword(")") {
+				return in, nil
+			}
+			if !p.keyword(",") {
+				return nil, fmt.Errorf("expected ',' or ')' in the values of '%v in'", name)
+			}
+		}
+	}
+	if p.i >= len(p.tokens) || p.tokens[p.i].quoted {
+		return nil, fmt.Errorf("expected an operator after '%v'", name)
+	}
+	op := p.tokens[p.i].text
+	p.i++
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	cmp := &whereCmp{name: name, op: op, value: value}
+	switch op {
+	case "=", "==", "!=":
+	case "~", "!~":
+		cmp.re, err = regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+	case "<", "<=", ">", ">=":
+		cmp.num, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number after '%v %v' got '%v'", name, op, value)
+		}
+	default:
+		return nil, fmt.Errorf("unknown operator '%v' (expected = != ~ !~ < <= > or >=)", op)
+	}
+	return cmp, nil
+}
+
+type whereOr struct {
+	a, b Where
+}
+
+func (w *whereOr) Match(meta Metadata) bool {
+	return w.a.Match(meta) || w.b.Match(meta)
+}
+
+func (w *whereOr) String() string {
+	return fmt.Sprintf("(%v or %v)", w.a, w.b)
+}
+
+type whereAnd struct {
+	a, b Where
+}
+
+func (w *whereAnd) Match(meta Metadata) bool {
+	return w.a.Match(meta) && w.b.Match(meta)
+}
+
+func (w *whereAnd) String() string {
+	return fmt.Sprintf("(%v and %v)", w.a, w.b)
+}
+
+type whereNot struct {
+	w Where
+}
+
+func (w *whereNot) Match(meta Metadata) bool {
+	return !w.w.Match(meta)
+}
+
+func (w *whereNot) String() string {
+	return fmt.Sprintf("not %v", w.w)
+}
+
+type whereIn struct {
+	name string
+	values []string
+}
+
+func (w *whereIn) Match(meta Metadata) bool {
+	for _, v := range w.values {
+		if meta[w.name] == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *whereIn) String() string {
+	return fmt.Sprintf("%v in (%v)", w.name, strings.Join(w.values, ", "))
+}
+
+// whereCmp compares the value of a variable. Every variable is a string, so
+// =, != and the regular expressions compare the text while <, <=, > and >=
+// parse the value as a number whatever the format field's type. The numeric
+// comparisons are false for values which are not numbers.
+type whereCmp struct {
+	name, op, value string
+	re *regexp.Regexp
+	num float64
+}
+
+func (w *whereCmp) Match(meta Metadata) bool {
+	v := meta[w.name]
+	switch w.op {
+	case "=", "==":
+		return v == w.value
+	case "!=":
+		return v != w.value
+	case "~":
+		return w.re.MatchString(v)
+	case "!~":
+		return !w.re.MatchString(v)
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return false
+	}
+	switch w.op {
+	case "<":
+		return n < w.num
+	case "<=":
+		return n <= w.num
+	case ">":
+		return n > w.num
+	default:
+		return n >= w.num
+	}
+}
+
+func (w *whereCmp) String() string {
+	return fmt.Sprintf("%v %v '%v'", w.name, w.op, w.value)
+}
@@ -0,0 +1,54 @@
+package ingest
+
+import "testing"
+
+func TestWhere(t *testing.T) {
+	meta := Metadata{"subject": "rat-2", "region": "L1", "stain": "DAPI", "z": "7", "note": "re capture"}
+	cases := map[string]bool{
+		"region = L1": true,
+		"region != L1": false,
+		"subject in (rat-1, rat-2)": true,
+		"subject in (rat-1,rat-3)": false,
+		"stain ~ '^DA'": true,
+		"stain !~ 'PI$'": false,
+		"z <= 10 and z > 7": false,
+		"z >= 7 and z < 10": true,
+		"region < 3": false,
+		"region = L2 or stain = DAPI": true,
+		"region = L2 or stain = DAPI and z > 9": false,
+		"(region = L2 or stain = DAPI) and z > 6": true,
+		"not region = L2": true,
+		"note = 're capture'": true,
+		"missing = ''": true,
+	}
+	for s, expected := range cases {
+		w, err := ParseWhere(s)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		if w.Match(meta) != expected {
+			t.Fatal("expected", s, "to be", expected, "parsed as", w)
+		}
+	}
+	for _, s := range []string{"", "region", "region =", "z < ten", "stain ~ '('", "subject in (a, b", "(region = L1", "region = L1 L2", "note = 'open"} {
+		if _, err := ParseWhere(s); err == nil {
+			t.Fatal("expected an error parsing", s)
+		}
+	}
+}
+
+func TestFilterImages(t *testing.T) {
+	images := []*Image{
+		{Path: "a", Metadata: Metadata{"region": "L1"}},
+		{Path: "b", Metadata: Metadata{"region": "L2"}},
+		{Path: "c", Metadata: Metadata{"region": "L1"}},
+	}
+	w, err := ParseWhere("region = L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := FilterImages(images, w)
+	if len(kept) != 2 || kept[0].Path != "a" || kept[1].Path != "c" {
+		t.Fatal("wrong images kept", kept)
+	}
+}
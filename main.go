@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -15,6 +16,7 @@ import (
 import (
 	"github.com/timtadh/wide-view-microscopy/ingest"
 	"github.com/timtadh/wide-view-microscopy/charts"
+	"github.com/timtadh/wide-view-microscopy/measure"
 )
 
 
@@ -22,6 +24,21 @@ var UsageMessage string = "wide-view-microscopy --help"
 var ExtendedMessage string = `
 wide-view-microscopy -d <path> -o <out.html> \
                      -f '$(slide) $(subject) $(region) $(stain).tif'
+wide-view-microscopy measure -d <path> -o <out.csv> \
+                     -f '$(slide) $(subject) $(region) $(stain).tif'
+
++----------+
+| Commands |
++----------+
+
+(none)              make the html charts
+measure             write a csv with the intensity statistics (min, max,
+                    mean, median, percentiles, integrated density and the
+                    fraction of saturated pixels) of each channel of each
+                    image, one row per channel. the statistics are
+                    computed on the original (flat-field corrected) data
+                    before projection and stitching. the first columns are
+                    the variables of the image
 
 +---------+
 | Options |
@@ -29,17 +46,122 @@ wide-view-microscopy -d <path> -o <out.html> \
 
 -h, --help                          view this message
 -d, directory=<path>                the directory where the imanges are stored
--o, output=<path>                   output for the html
+-o, output=<path>                   output for the html (or csv)
                                     (optional will go to stdout)
 -f, format=<format-string>          a format for the names of the images
                                     default: '$(slide) $(subject) $(region) $(stain).tif'
+--flat-field=<path>                 a directory of flat-field references to
+                                    correct uneven illumination with
+--dark-frame=<path>                 a directory of dark-frame references
+--reference-format=<format-string>  a format for the names of the references.
+                                    a reference is used for the images whose
+                                    metadata matches all of its variables
+                                    default: '$(stain).tif'
+--preview=<encoder>                 the format of the previews shown in the
+                                    html (and of overlays, mosaics, etc.)
+                                    default: 'jpeg'
+--pyramid=<tile-size>               also write a pyramid of tiles for images
+                                    too large to preview at full resolution
+                                    (eg. whole slide scans)
 -r, row-group=<vars>                variables to group row on
                                     default: 'region'
 -c, chart-group=<vars>              variables to group charts on
                                     default: 'subject,slide'
--s, column-sort=<vars>              variables to sort columns on
+--section=<vars>                    group the charts into sections on these
+                                    variables. give it more than once to nest
+                                    sections, outermost first
+--row-section=<vars>                group the rows of each chart on these
+                                    variables, under a heading. give it more
+                                    than once to nest the groups, outermost
+                                    first
+--transpose                         swap the rows and the columns, eg. to
+                                    have a row per stain (-s) and a column
+                                    per region (-r). the overlays become rows.
+                                    can not be used with --row-section
+--collisions=<collision-policy>     what to do when several images have the
+                                    same chart, row and column (eg. a
+                                    re-capture)
+                                    default: 'columns'
+-s, column-sort=<vars>              variables to sort columns on. the
+                                    columns are headed by their values, a
+                                    header row per variable
                                     default: 'stain'
+--order=<var>=<order>               how to sort the values of a variable (for
+                                    the charts, rows and columns). the order
+                                    is a list of values (eg.
+                                    'stain=TRITC,FITC,DAPI'), 'alpha',
+                                    'natural' (L2 before L10) or 'numeric',
+                                    optionally suffixed with '-desc'. may be
+                                    given once per variable
+                                    default: 'alpha'
+--where=<filter>                    only chart the images whose metadata
+                                    matches the filter, eg.
+                                    "subject in (rat-1, rat-2) and z <= 10".
+                                    see Filters. when given more than once
+                                    the images must match all of them
 --overlap-columns=<vals>            values of the first sort column to overlap
+                                    in an overlay after the other columns
+--overlay=<name>=<vals>             also overlay these values of the first
+                                    sort column, in a column headed by the
+                                    name, eg. 'merge=DAPI,FITC,TRITC'. the
+                                    column is placed by the order of the
+                                    variable (see --order). may be given
+                                    more than once
+--projection=<projection>           collapse stacks of images into one
+                                    projected image
+                                    default: 'none'
+--project-on=<var>                  the variable which differs between the
+                                    images of a stack
+                                    default: 'z'
+--mosaic=<vars>                     stitch tiles into a mosaic. the vars are
+                                    the row and column of each tile, eg.
+                                    'row,col'
+--mosaic-overlap=<fraction>         how much neighboring tiles overlap
+                                    default: '0.1'
+--mosaic-refine                     refine the tile positions by correlating
+                                    the overlapping strips of neighbors
+--scale-bar=<length>                draw a scale bar on the images. the length
+                                    is in microns or 'auto'
+--scale-bar-label                   write the length above the scale bar
+--pixel-size=<microns>              the width of a pixel. overrides the pixel
+                                    size from '<name>.pixel-size' sidecar
+                                    files and the tiff resolution tags
+--register=<registration>           align the overlapped columns before
+                                    overlaying them
+                                    default: 'none'
+--overlay-size=<size-policy>        what to do when the overlapped columns
+                                    have different dimensions
+                                    default: 'refuse'
+--segment=<threshold>               count the objects (eg. nuclei) in the
+                                    images. adds a mask column after each
+                                    segmented column and the counts to the
+                                    measure csv
+--segment-columns=<vals>            values of the first sort column to
+                                    segment
+                                    default: all of them
+--min-area=<pixels>                 ignore objects smaller than this
+                                    default: '0'
+--max-area=<pixels>                 ignore objects larger than this
+                                    default: no maximum
+--duplicate-distance=<bits>         images whose perceptual hashes differ by
+                                    at most this many bits (of 64) are
+                                    reported as near-duplicates
+                                    default: '4'
+--fail-on-duplicates                exit with an error when there are
+                                    duplicates
+--min-focus=<focus>                 drop the images with a focus score (the
+                                    variance of their laplacian) below this
+--quarantine                        show the images failing --min-focus in a
+                                    chart of their own instead of dropping
+                                    them
+--no-quality                        do not score the focus and exposure of
+                                    the images (nor flag the blurry or
+                                    overexposed ones)
+--colocalization=<path>             compute Pearson's r and Manders' M1/M2
+                                    (with Costes' thresholds) for each pair
+                                    of overlapped columns. they are shown
+                                    under the overlays and written to this
+                                    csv
 
 +-------+
 | Specs |
@@ -48,6 +170,55 @@ wide-view-microscopy -d <path> -o <out.html> \
 <format-string>     See below
 <path>              A file system path
 <vars>              A comma separated list of variables.
+<projection>        How to project stacks (eg. z-stacks):
+                      none  leave the stacks as they are
+                      max   maximum intensity projection
+                      mean  mean intensity projection
+                      min   minimum intensity projection
+<encoder>           The format to write previews in:
+                      jpeg            jpeg with the default quality (75)
+                      jpeg:<quality>  jpeg with quality 1-100
+                      png             lossless png, keeps transparency
+<threshold>         How to separate objects from the background:
+                      otsu     pick a threshold with Otsu's method
+                      <value>  pixels above the value (in the units of the
+                               original image, eg. 0-255 or 0-65535)
+<registration>      How to register images before overlaying:
+                      none         use the images as they are
+                      translation  correct stage drift with phase
+                                   correlation
+<collision-policy>  What to do with the images which land in the same cell:
+                      columns      give each image a column of its own
+                      newest       keep the image modified last
+                      first:<var>  keep the first image in the order of the
+                                   variable (see --order)
+                      stack        stack the images in the cell, scroll
+                                   sideways through them
+                      fail         exit with an error
+<size-policy>       How to overlay images of different dimensions:
+                      refuse    show an error in place of the overlay
+                                and report the files
+                      resample  resize every image to the largest one
+                      crop      crop every image to the common area
+
++---------+
+| Filters |
++---------+
+
+A filter compares the variables of each image:
+
+<var> = <value>           equal (!= for not equal)
+<var> in (<v1>, <v2>)     one of the values
+<var> ~ <regexp>          matches the regular expression (!~ for does not)
+<var> < <number>          a numeric comparison (also <=, > and >=) of any
+                          variable whose value is a number (eg. "007" is 7).
+                          false when the value is not a number
+<filter> and <filter>     both
+<filter> or <filter>      either (and binds tighter than or)
+not <filter>              the opposite
+(<filter>)                grouping
+
+Values containing spaces or any of ()=!~<>, are quoted with ' or ".
 
 +---------------+
 | Format Fields |
@@ -60,6 +231,17 @@ $(region)   string  the identifier for the region of the slide the image is
                     from (required)
 $(stain)    string  the stain type which was used for this image (required)
 
+Multi-page tiffs and OME-TIFFs are split into one image per page. Each page
+gets these variables in addition to the ones parsed from the file name (use
+them in the -r, -c and -s options):
+
+$(page)     int     the 1-based page number
+$(channel)  string  the channel, from the OME-XML, the page description or
+                    the ImageJ channel number
+$(z)        int     the z-slice number (OME-TIFF and ImageJ)
+$(t)        int     the time point (OME-TIFF and ImageJ)
+$(series)   string  the image within an OME-TIFF holding several
+
 
 +----------------+
 | Format Strings |
@@ -92,19 +274,50 @@ func Vars(str string) []string {
 	return vars
 }
 
+func Directory(opt, arg string) string {
+	directory, err := filepath.Abs(arg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad directory (%v) '%v' supplied\n", opt, arg)
+		Usage(1)
+	}
+	if _, err := os.Stat(directory); err != nil && os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Bad directory (%v) '%v' supplied\n", opt, arg)
+		Usage(1)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintf(os.Stderr, "Bad directory (%v) '%v' supplied\n", opt, arg)
+		Usage(1)
+	}
+	return directory
+}
+
 func main() {
 	args, optargs, err := getopt.GetOpt(
 		os.Args[1:],
 		"hl:d:o:f:s:r:c:",
 		[]string{ "help", "directory=", "output=", "format=",
-		          "column-sort=", "row-group=", "chart-group=",
-		          "overlap-columns=",},
+		          "column-sort=", "row-group=", "chart-group=", "order=",
+		          "section=", "row-section=", "transpose", "collisions=",
+		          "overlay=",
+		          "overlap-columns=", "register=", "overlay-size=",
+		          "projection=", "project-on=", "mosaic=", "mosaic-overlap=",
+		          "mosaic-refine", "flat-field=", "dark-frame=",
+		          "reference-format=", "scale-bar=", "scale-bar-label",
+		          "pixel-size=", "preview=", "pyramid=",
+		          "colocalization=", "segment=", "segment-columns=",
+		          "min-area=", "max-area=", "min-focus=", "quarantine", "no-quality",
+		          "duplicate-distance=", "fail-on-duplicates",
+		          "where=",},
 	)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error parsing command line flags", err)
 		Usage(1)
 	}
-	if len(args) > 0 {
+	command := ""
+	var wheres []ingest.Where
+	if len(args) == 1 && args[0] == "measure" {
+		command = args[0]
+	} else if len(args) > 0 {
 		fmt.Fprintf(os.Stderr, "unexpected trailing args `%v`\n", strings.Join(args, " "))
 		Usage(1)
 	}
@@ -114,10 +327,43 @@ func main() {
 		log.Fatal(err)
 	}
 	directory := ""
+	output := ""
+	flatDir := ""
+	darkDir := ""
+	refFormat, err := ingest.ParseFormatString("$(stain).tif")
+	if err != nil {
+		log.Fatal(err)
+	}
 	rowGroup := Vars("region")
 	chartGroup := Vars("subject,slide")
+	var sections, rowSections [][]string
+	transpose := false
+	var collisions *charts.Collisions
 	columnSort := Vars("stain")
 	overlapCols := Vars("")
+	var overlays []*charts.OverlayDef
+	orders := charts.Orders{}
+	overlayOpts := &charts.OverlayOptions{}
+	projection := ingest.NoProjection
+	projectOn := "z"
+	var mosaicOpts *charts.MosaicOptions
+	mosaicOverlap := .1
+	mosaicRefine := false
+	var scaleBar *ingest.ScaleBar
+	scaleBarLabel := false
+	pixelSize := 0.0
+	pyramid := 0
+	var previews ingest.Previews
+	colocOutput := ""
+	var segmentation *measure.Segmentation
+	segmentCols := Vars("")
+	minArea := 0
+	maxArea := 0
+	minFocus := 0.0
+	duplicateDistance := 4
+	failOnDuplicates := false
+	quarantine := false
+	noQuality := false
 	for _, oa := range optargs {
 		switch oa.Opt() {
 		case "-h", "--help":
@@ -131,17 +377,18 @@ func main() {
 				Usage(1)
 			}
 		case "-d", "--directory":
-			directory, err = filepath.Abs(oa.Arg())
+			directory = Directory(oa.Opt(), oa.Arg())
+		case "-o", "--output":
+			output = oa.Arg()
+		case "--flat-field":
+			flatDir = Directory(oa.Opt(), oa.Arg())
+		case "--dark-frame":
+			darkDir = Directory(oa.Opt(), oa.Arg())
+		case "--reference-format":
+			refFormat, err = ingest.ParseFormatString(oa.Arg())
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Bad directory (%v) '%v' supplied\n", oa.Opt(), oa.Arg())
-				Usage(1)
-			}
-			if _, err := os.Stat(directory); err != nil && os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "Bad directory (%v) '%v' supplied\n", oa.Opt(), oa.Arg())
-				Usage(1)
-			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid format string (%v) '%v'\n", oa.Opt(), oa.Arg())
 				fmt.Fprintln(os.Stderr, err)
-				fmt.Fprintf(os.Stderr, "Bad directory (%v) '%v' supplied\n", oa.Opt(), oa.Arg())
 				Usage(1)
 			}
 		case "-s", "--column-sort":
@@ -150,26 +397,319 @@ func main() {
 			rowGroup = Vars(oa.Arg())
 		case "-c", "--chart-group":
 			chartGroup = Vars(oa.Arg())
+		case "--section":
+			sections = append(sections, Vars(oa.Arg()))
+		case "--row-section":
+			rowSections = append(rowSections, Vars(oa.Arg()))
+		case "--transpose":
+			transpose = true
+		case "--collisions":
+			collisions, err = charts.ParseCollisions(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid collision policy (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
+		case "--where":
+			w, err := ingest.ParseWhere(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid filter (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
+			wheres = append(wheres, w)
+		case "--order":
+			name, order, err := charts.ParseOrder(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid order (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
+			orders[name] = order
 		case "--overlap-columns":
 			overlapCols = Vars(oa.Arg())
+		case "--overlay":
+			def, err := charts.ParseOverlayDef(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid overlay (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
+			overlays = append(overlays, def)
+		case "--register":
+			overlayOpts.Register, err = charts.ParseRegistration(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid registration (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
+		case "--projection":
+			projection, err = ingest.ParseProjection(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid projection (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
+		case "--project-on":
+			projectOn = strings.TrimSpace(oa.Arg())
+		case "--mosaic":
+			vars := Vars(oa.Arg())
+			if len(vars) != 2 {
+				fmt.Fprintf(os.Stderr, "Expected a row and a column variable (%v) '%v'\n", oa.Opt(), oa.Arg())
+				Usage(1)
+			}
+			mosaicOpts = &charts.MosaicOptions{Row: vars[0], Col: vars[1]}
+		case "--mosaic-overlap":
+			mosaicOverlap, err = strconv.ParseFloat(oa.Arg(), 64)
+			if err != nil || mosaicOverlap < 0 || mosaicOverlap >= 1 {
+				fmt.Fprintf(os.Stderr, "Expected a fraction in [0, 1) (%v) '%v'\n", oa.Opt(), oa.Arg())
+				Usage(1)
+			}
+		case "--mosaic-refine":
+			mosaicRefine = true
+		case "--preview":
+			previews.Encoder, err = ingest.ParseEncoder(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid preview format (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
+		case "--segment":
+			segmentation, err = measure.ParseSegmentation(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid threshold (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
+		case "--segment-columns":
+			segmentCols = Vars(oa.Arg())
+		case "--min-area", "--max-area":
+			area, err := strconv.Atoi(oa.Arg())
+			if err != nil || area < 0 {
+				fmt.Fprintf(os.Stderr, "Expected an area in pixels (%v) '%v'\n", oa.Opt(), oa.Arg())
+				Usage(1)
+			}
+			if oa.Opt() == "--min-area" {
+				minArea = area
+			} else {
+				maxArea = area
+			}
+		case "--duplicate-distance":
+			duplicateDistance, err = strconv.Atoi(oa.Arg())
+			if err != nil || duplicateDistance < 0 || duplicateDistance > 64 {
+				fmt.Fprintf(os.Stderr, "Expected a number of bits from 0 to 64 (%v) '%v'\n", oa.Opt(), oa.Arg())
+				Usage(1)
+			}
+		case "--fail-on-duplicates":
+			failOnDuplicates = true
+		case "--min-focus":
+			minFocus, err = strconv.ParseFloat(oa.Arg(), 64)
+			if err != nil || minFocus < 0 {
+				fmt.Fprintf(os.Stderr, "Expected a focus score (%v) '%v'\n", oa.Opt(), oa.Arg())
+				Usage(1)
+			}
+		case "--quarantine":
+			quarantine = true
+		case "--no-quality":
+			noQuality = true
+		case "--colocalization":
+			colocOutput = oa.Arg()
+			overlayOpts.Colocalize = true
+		case "--pyramid":
+			pyramid, err = strconv.Atoi(oa.Arg())
+			if err != nil || pyramid < 1 {
+				fmt.Fprintf(os.Stderr, "Expected a tile size in pixels (%v) '%v'\n", oa.Opt(), oa.Arg())
+				Usage(1)
+			}
+		case "--scale-bar":
+			scaleBar = &ingest.ScaleBar{}
+			if oa.Arg() != "auto" {
+				scaleBar.Length, err = strconv.ParseFloat(oa.Arg(), 64)
+				if err != nil || scaleBar.Length <= 0 {
+					fmt.Fprintf(os.Stderr, "Expected a length in microns or 'auto' (%v) '%v'\n", oa.Opt(), oa.Arg())
+					Usage(1)
+				}
+			}
+		case "--scale-bar-label":
+			scaleBarLabel = true
+		case "--pixel-size":
+			pixelSize, err = strconv.ParseFloat(oa.Arg(), 64)
+			if err != nil || pixelSize <= 0 {
+				fmt.Fprintf(os.Stderr, "Expected a size in microns (%v) '%v'\n", oa.Opt(), oa.Arg())
+				Usage(1)
+			}
+		case "--overlay-size":
+			overlayOpts.Sizes, err = charts.ParseSizePolicy(oa.Arg())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid size policy (%v) '%v'\n", oa.Opt(), oa.Arg())
+				fmt.Fprintln(os.Stderr, err)
+				Usage(1)
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "Unknown flag '%v'\n", oa.Opt())
 			Usage(1)
 		}
 	}
+	if transpose && len(rowSections) > 0 {
+		fmt.Fprintln(os.Stderr, "--transpose can not be used with --row-section")
+		Usage(1)
+	}
+	if noQuality && (minFocus > 0 || quarantine) {
+		fmt.Fprintln(os.Stderr, "--no-quality can not be used with --min-focus or --quarantine")
+		Usage(1)
+	}
 
 	log.Println(directory)
 
-	files, err := ingest.Ingest(directory, format)
+	conv := &ingest.Converter{Previews: previews, Pyramid: pyramid}
+	if flatDir != "" || darkDir != "" {
+		conv.Correction = &ingest.Correction{}
+	}
+	if flatDir != "" {
+		conv.Correction.Flats, err = ingest.LoadReferences(flatDir, refFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if darkDir != "" {
+		conv.Correction.Darks, err = ingest.LoadReferences(darkDir, refFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	overlayOpts.Correction = conv.Correction
+	overlayOpts.Previews = previews
+	if segmentation != nil {
+		segmentation.Previews = previews
+		segmentation.MinArea = minArea
+		segmentation.MaxArea = maxArea
+		if len(columnSort) > 0 {
+			segmentation.On = columnSort[0]
+			segmentation.Values = segmentCols
+		}
+	}
+
+	out := os.Stdout
+	if output != "" {
+		out, err = os.Create(output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+
+	files, err := ingest.Ingest(directory, format, conv)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, w := range wheres {
+		kept := ingest.FilterImages(files, w)
+		log.Printf("kept %d of %d images where %v", len(kept), len(files), w)
+		files = kept
+	}
+	dups := ingest.FindDuplicates(files, duplicateDistance)
+	for _, dup := range dups {
+		log.Println("WARN", dup)
+	}
+	if failOnDuplicates && len(dups) > 0 {
+		log.Fatalf("found %d duplicate images", len(dups))
+	}
+	if command == "measure" {
+		measured, stats := measure.Measure(files, conv.Correction, segmentation)
+		err = measure.WriteStatsCSV(out, measured, stats)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("done")
+		return
+	}
+	files = ingest.Project(files, projectOn, projection, previews.Encoder)
+	if mosaicOpts != nil {
+		mosaicOpts.Overlap = mosaicOverlap
+		mosaicOpts.Refine = mosaicRefine
+		mosaicOpts.Previews = previews
+		files, err = charts.Mosaic(files, mosaicOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var failed []*ingest.Image
+	if !noQuality {
+		qualityOn := ""
+		if len(columnSort) > 0 {
+			qualityOn = columnSort[0]
+		}
+		check := measure.DefaultQualityCheck(qualityOn)
+		check.MinFocus = minFocus
+		files, failed = check.Check(files, conv.Correction)
+		for _, img := range failed {
+			log.Println("WARN", "image", img.Path, "is out of focus, focus", img.Note("focus"), "<", minFocus)
+		}
+	}
+	if segmentation != nil {
+		files = segmentation.SegmentImages(files, conv.Correction)
+	}
 	log.Println(files)
 	for _, img := range files {
 		log.Println(img)
 	}
 
-	C := charts.MakeCharts(files, chartGroup, rowGroup, columnSort, overlapCols) 
+	layout := &charts.Layout{
+		Sections: sections,
+		Charts: chartGroup,
+		RowGroups: rowSections,
+		Rows: rowGroup,
+		Columns: columnSort,
+		Collisions: collisions,
+		Orders: orders,
+	}
+	if len(columnSort) > 0 {
+		layout.OverlayOn = columnSort[0]
+	}
+	if transpose {
+		if err := layout.Transpose(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(overlapCols) > 1 {
+		layout.Overlays = append(layout.Overlays, &charts.OverlayDef{Values: overlapCols})
+	}
+	layout.Overlays = append(layout.Overlays, overlays...)
+	// the charts are made without the images which failed, they are reported
+	// after the html is written
+	root, err := charts.MakeLayout(files, layout, overlayOpts)
+	failures, partial := err.(charts.Errors)
+	if err != nil && !partial {
+		log.Fatal(err)
+	}
+	if quarantine && len(failed) > 0 {
+		root.Add(charts.QuarantineChart(failed, layout))
+	}
+	C := root.AllCharts()
+	if collisions := charts.CollisionSummary(C); collisions != "" {
+		log.Println("WARN", "some cells have more than one image (see --collisions)\n" + collisions)
+	}
+	if missing := charts.MissingSummary(C); missing != "" {
+		log.Println("WARN", "some charts have cells with no image\n" + missing)
+	}
+	if colocOutput != "" {
+		f, err := os.Create(colocOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = charts.WriteColocalizationCSV(f, C)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if scaleBar != nil {
+		scaleBar.Label = scaleBarLabel
+		scaleBar.PixelSize = pixelSize
+		scaleBar.Previews = previews
+		charts.BurnScaleBars(C, scaleBar)
+	}
 	for _, chart := range C {
 		log.Println("chart", chart.Meta())
 		for _, row := range chart.Rows() {
@@ -182,7 +722,14 @@ func main() {
 		log.Println()
 	}
 
+	html, err := charts.LayoutHTML(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(out, html)
+	if len(failures) > 0 {
+		log.Fatal(failures)
+	}
 	log.Println("done")
-	fmt.Println(charts.ChartsHTML(C))
 }
 
@@ -0,0 +1,213 @@
+package measure
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strconv"
+)
+
+
+// Coloc holds the colocalization coefficients of two channels.
+type Coloc struct {
+	// the names of the channels (eg. their stains).
+	A, B string
+	// Pearson's correlation coefficient of all the overlapping pixels.
+	Pearson float64
+	// Manders' coefficients: the fraction of the intensity of A (above its
+	// threshold) in pixels where B is above its threshold, and vice versa.
+	M1, M2 float64
+	// the Costes thresholds of A and B.
+	ThresholdA, ThresholdB float64
+}
+
+// Colocalize computes the colocalization of a and b, where b is placed at
+// offset in the coordinates of a (see charts.Registration). Only the pixels
+// where the images overlap are used. The thresholds for the Manders'
+// coefficients are found with Costes' method: the highest thresholds on the
+// regression line of b on a for which the pixels below them are not
+// positively correlated.
+func Colocalize(a, b image.Image, offset image.Point) (*Coloc, error) {
+	as, bs := paired(a, b, offset)
+	if len(as) < 2 {
+		return nil, fmt.Errorf("the images do not overlap")
+	}
+	c := &Coloc{Pearson: pearson(as, bs, nil)}
+	slope, intercept := regression(as, bs)
+	max := 0
+	for _, v := range as {
+		if int(v) > max {
+			max = int(v)
+		}
+	}
+	threshold := func(t int) float64 {
+		return slope*float64(t) + intercept
+	}
+	uncorrelated := func(t int) bool {
+		tb := threshold(t)
+		r := pearson(as, bs, func(i int) bool {
+			return float64(as[i]) <= float64(t) || float64(bs[i]) <= tb
+		})
+		return math.IsNaN(r) || r <= 0
+	}
+	ta := max
+	if slope > 0 && !uncorrelated(max) {
+		// uncorrelated(lo) and !uncorrelated(hi)
+		lo, hi := 0, max
+		for hi - lo > 1 {
+			mid := (lo + hi) / 2
+			if uncorrelated(mid) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		ta = lo
+	}
+	c.ThresholdA = float64(ta)
+	c.ThresholdB = math.Max(threshold(ta), 0)
+	if slope <= 0 {
+		// there is no regression line to follow
+		c.ThresholdA, c.ThresholdB = 0, 0
+	}
+	var sumA, sumB, colocA, colocB float64
+	for i := range as {
+		va, vb := float64(as[i]), float64(bs[i])
+		aboveA, aboveB := va > c.ThresholdA, vb > c.ThresholdB
+		if aboveA {
+			sumA += va
+		}
+		if aboveB {
+			sumB += vb
+		}
+		if aboveA && aboveB {
+			colocA += va
+			colocB += vb
+		}
+	}
+	if sumA > 0 {
+		c.M1 = colocA / sumA
+	}
+	if sumB > 0 {
+		c.M2 = colocB / sumB
+	}
+	return c, nil
+}
+
+// paired collects the intensities of the pixels of a and b which overlap.
+func paired(a, b image.Image, offset image.Point) (as, bs []uint16) {
+	ab := a.Bounds().Sub(a.Bounds().Min)
+	bb := b.Bounds().Sub(b.Bounds().Min).Add(offset)
+	overlap := ab.Intersect(bb)
+	if overlap.Empty() {
+		return nil, nil
+	}
+	bVals := make([]uint16, b.Bounds().Dx()*b.Bounds().Dy())
+	Values(b, func(x, y int, v uint16) {
+		bVals[y*b.Bounds().Dx() + x] = v
+	})
+	as = make([]uint16, 0, overlap.Dx()*overlap.Dy())
+	bs = make([]uint16, 0, overlap.Dx()*overlap.Dy())
+	Values(a, func(x, y int, v uint16) {
+		if !image.Pt(x, y).In(overlap) {
+			return
+		}
+		as = append(as, v)
+		bs = append(bs, bVals[(y - offset.Y)*b.Bounds().Dx() + x - offset.X])
+	})
+	return as, bs
+}
+
+// pearson is the correlation of the pixels for which include is true (all of
+// them when include is nil). It is NaN if either channel is constant.
+func pearson(as, bs []uint16, include func(i int) bool) float64 {
+	var n, sa, sb, saa, sbb, sab float64
+	for i := range as {
+		if include != nil && !include(i) {
+			continue
+		}
+		a, b := float64(as[i]), float64(bs[i])
+		n++
+		sa += a
+		sb += b
+		saa += a*a
+		sbb += b*b
+		sab += a*b
+	}
+	cov := sab - sa*sb/n
+	va := saa - sa*sa/n
+	vb := sbb - sb*sb/n
+	if n < 2 || va <= 0 || vb <= 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(va*vb)
+}
+
+// regression fits b = slope*a + intercept by least squares.
+func regression(as, bs []uint16) (slope, intercept float64) {
+	var n, sa, sb, saa, sab float64
+	for i := range as {
+		a, b := float64(as[i]), float64(bs[i])
+		n++
+		sa += a
+		sb += b
+		saa += a*a
+		sab += a*b
+	}
+	va := saa - sa*sa/n
+	if va <= 0 {
+		return 0, sb/n
+	}
+	slope = (sab - sa*sb/n) / va
+	return slope, (sb - slope*sa) / n
+}
+
+func (c *Coloc) String() string {
+	return fmt.Sprintf("%v/%v r=%.2f M1=%.2f M2=%.2f", c.A, c.B, c.Pearson, c.M1, c.M2)
+}
+
+// ColocColumns are the names of the columns of Coloc.Values.
+func ColocColumns() []string {
+	return []string{"channel_a", "channel_b", "pearson", "m1", "m2", "threshold_a", "threshold_b"}
+}
+
+func (c *Coloc) Values() []string {
+	return []string{c.A, c.B, format(c.Pearson), format(c.M1), format(c.M2), format(c.ThresholdA), format(c.ThresholdB)}
+}
+
+// WriteColocs writes the coefficients as csv rows (without a header), to be
+// read back by ReadColocs.
+func WriteColocs(w io.Writer, colocs []*Coloc) error {
+	out := csv.NewWriter(w)
+	for _, c := range colocs {
+		if err := out.Write(c.Values()); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func ReadColocs(r io.Reader) ([]*Coloc, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	colocs := make([]*Coloc, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != len(ColocColumns()) {
+			return nil, fmt.Errorf("expected %d colocalization columns got %d", len(ColocColumns()), len(row))
+		}
+		c := &Coloc{A: row[0], B: row[1]}
+		for i, to := range []*float64{&c.Pearson, &c.M1, &c.M2, &c.ThresholdA, &c.ThresholdB} {
+			*to, err = strconv.ParseFloat(row[i+2], 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+		colocs = append(colocs, c)
+	}
+	return colocs, nil
+}
@@ -0,0 +1,89 @@
+package measure
+
+import "testing"
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+)
+
+// spots is a dark image with bright squares at each of the points. The
+// background pattern varies with seed.
+func spots(w, h int, at []image.Point, seed int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(10 + (i*seed) % 7)
+	}
+	for _, p := range at {
+		for y := p.Y; y < p.Y + 4; y++ {
+			for x := p.X; x < p.X + 4; x++ {
+				img.SetGray(x, y, color.Gray{uint8(200 + (x*y) % 50)})
+			}
+		}
+	}
+	return img
+}
+
+func TestColocalizeSame(t *testing.T) {
+	a := spots(40, 40, []image.Point{{5, 5}, {20, 30}, {30, 10}}, 1)
+	c, err := Colocalize(a, a, image.ZP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(c.Pearson - 1) > 1e-9 {
+		t.Fatal("expected r = 1 got", c.Pearson)
+	}
+	if c.M1 < .99 || c.M2 < .99 {
+		t.Fatal("expected complete colocalization got", c.M1, c.M2)
+	}
+}
+
+func TestColocalizePartial(t *testing.T) {
+	a := spots(40, 40, []image.Point{{5, 5}, {20, 30}}, 1)
+	b := spots(40, 40, []image.Point{{5, 5}, {30, 10}}, 3)
+	c, err := Colocalize(a, b, image.ZP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Pearson <= 0 || c.Pearson >= 1 {
+		t.Fatal("expected a partial correlation got", c.Pearson)
+	}
+	if c.M1 < .25 || c.M1 > .75 || c.M2 < .25 || c.M2 > .75 {
+		t.Fatal("expected about half of each channel to colocalize got", c.M1, c.M2)
+	}
+	if c.ThresholdA <= 16 || c.ThresholdB <= 16 {
+		t.Fatal("expected thresholds above the background got", c.ThresholdA, c.ThresholdB)
+	}
+}
+
+func TestColocalizeOffset(t *testing.T) {
+	a := spots(40, 40, []image.Point{{10, 10}, {25, 20}}, 1)
+	b := spots(40, 40, []image.Point{{7, 8}, {22, 18}}, 3)
+	c, err := Colocalize(a, b, image.Pt(3, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Pearson < .9 {
+		t.Fatal("expected the shifted spots to correlate got", c.Pearson)
+	}
+	if _, err := Colocalize(a, b, image.Pt(40, 0)); err == nil {
+		t.Fatal("expected an error for images which do not overlap")
+	}
+}
+
+func TestColocsRoundTrip(t *testing.T) {
+	colocs := []*Coloc{{A: "FITC", B: "TRITC", Pearson: .5, M1: .25, M2: .75, ThresholdA: 12, ThresholdB: 30}}
+	buf := new(bytes.Buffer)
+	if err := WriteColocs(buf, colocs); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadColocs(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 || *read[0] != *colocs[0] {
+		t.Fatal("expected", colocs[0], "got", read)
+	}
+}
@@ -0,0 +1,88 @@
+package measure
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+// WriteCSV writes a row for each image. The first columns are the metadata of
+// the images (every key of any of the images, in sorted order) so the table
+// can be pivoted on them, then the file the image was read from and its page,
+// then columns with the values for the image.
+func WriteCSV(w io.Writer, images []*ingest.Image, columns []string, values [][]string) error {
+	if len(images) != len(values) {
+		return fmt.Errorf("%d images but %d rows of values", len(images), len(values))
+	}
+	keys := MetadataKeys(images)
+	out := csv.NewWriter(w)
+	header := append(append(append([]string{}, keys...), "source", "page"), columns...)
+	if err := out.Write(header); err != nil {
+		return err
+	}
+	for i, img := range images {
+		row := make([]string, 0, len(header))
+		for _, k := range keys {
+			row = append(row, img.Meta()[k])
+		}
+		source := img.Source
+		if source == "" {
+			source = img.Path
+		}
+		row = append(row, source, fmt.Sprint(img.Page))
+		row = append(row, values[i]...)
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// MetadataKeys is every metadata key used by the images, sorted.
+func MetadataKeys(images []*ingest.Image) []string {
+	seen := make(map[string]bool)
+	keys := make([]string, 0, 4)
+	for _, img := range images {
+		for k := range img.Meta() {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteStatsCSV writes the stats of each image (see WriteCSV), a row for each
+// channel as listed by Measure. When some of
+// the images were segmented there are also columns for their objects, which
+// are empty for the others.
+func WriteStatsCSV(w io.Writer, images []*ingest.Image, stats []*Stats) error {
+	segmented := false
+	for _, s := range stats {
+		segmented = segmented || s.Objects != nil
+	}
+	columns := StatsColumns()
+	if segmented {
+		columns = append(columns, ObjectsColumns()...)
+	}
+	values := make([][]string, 0, len(stats))
+	for _, s := range stats {
+		row := s.Values()
+		if s.Objects != nil {
+			row = append(row, s.Objects.Values()...)
+		} else if segmented {
+			row = append(row, make([]string, len(ObjectsColumns()))...)
+		}
+		values = append(values, row)
+	}
+	return WriteCSV(w, images, columns, values)
+}
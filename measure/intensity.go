@@ -0,0 +1,262 @@
+package measure
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strconv"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+// Percentiles are the percentiles reported by Intensity besides the median.
+var Percentiles = []float64{1, 5, 25, 75, 95, 99}
+
+// Stats summarize the intensities of a channel of an image. The intensities
+// are in the units of the image: 0-255 for 8 bit images and 0-65535 for 16
+// bit images.
+type Stats struct {
+	// gray, or red, green or blue for color images.
+	Channel string
+	Pixels int
+	Min, Max float64
+	Mean float64
+	Median float64
+	// one for each of Percentiles.
+	Percentiles []float64
+	// the sum of the intensities (ImageJ's RawIntDen).
+	IntegratedDensity float64
+	// the fraction of pixels at the largest value the image can hold.
+	Saturated float64
+	// the objects found in the image, nil unless it was segmented.
+	Objects *Objects
+}
+
+// Measure computes the stats of each channel of each image from its original
+// data (see ingest.Image.StreamOriginal), corrected by corr if it is not nil.
+// The originals are streamed a row at a time. An image is listed once for
+// each of its channels, alongside the stats of the channel. The images seg
+// applies to are also segmented, unless seg is nil, which needs the whole
+// original. Images which can not be read are logged and skipped.
+func Measure(images []*ingest.Image, corr *ingest.Correction, seg *Segmentation) ([]*ingest.Image, []*Stats) {
+	measured := make([]*ingest.Image, 0, len(images))
+	stats := make([]*Stats, 0, len(images))
+	for _, img := range images {
+		var channels []*Stats
+		err := img.StreamOriginal(func(src ingest.RowSource) (err error) {
+			src, err = corr.CorrectRows(src, img.Meta())
+			if err != nil {
+				return err
+			}
+			channels, err = ChannelIntensity(src)
+			return err
+		})
+		if err != nil {
+			log.Println("WARN", "could not measure", img.Path, "because", err)
+			continue
+		}
+		if seg != nil && seg.Applies(img) {
+			pix, err := Load(img, corr)
+			if err != nil {
+				log.Println("WARN", "could not segment", img.Path, "because", err)
+				continue
+			}
+			objects := seg.Segment(pix)
+			// only the areas are reported
+			objects.Labels = nil
+			for _, s := range channels {
+				s.Objects = objects
+			}
+		}
+		for _, s := range channels {
+			measured = append(measured, img)
+			stats = append(stats, s)
+		}
+	}
+	return measured, stats
+}
+
+// Load reads the original data of img, corrected by corr if it is not nil.
+// Corrected 8 bit images are kept at 8 bits so they are measured in the same
+// units as uncorrected ones.
+func Load(img *ingest.Image, corr *ingest.Correction) (image.Image, error) {
+	pix, err := img.Original()
+	if err != nil {
+		return nil, err
+	}
+	corrected, err := corr.Correct(pix, img.Meta())
+	if err != nil {
+		return nil, err
+	}
+	if Depth(pix) == 16 || Depth(corrected) == 8 {
+		return corrected, nil
+	}
+	b := corrected.Bounds()
+	var to draw.Image
+	if corrected.ColorModel() == color.Gray16Model {
+		to = image.NewGray(b)
+	} else {
+		to = image.NewRGBA(b)
+	}
+	draw.Draw(to, b, corrected, b.Min, draw.Src)
+	return to, nil
+}
+
+// Depth is the bits per sample of img, 8 or 16.
+func Depth(img image.Image) int {
+	switch img.ColorModel() {
+	case color.Gray16Model, color.RGBA64Model, color.NRGBA64Model, color.Alpha16Model:
+		return 16
+	default:
+		return 8
+	}
+}
+
+// Values calls fn with the intensity of each pixel of img, in the units of the
+// image (see Depth).
+func Values(img image.Image, fn func(x, y int, v uint16)) {
+	b := img.Bounds()
+	shift := uint(16 - Depth(img))
+	switch g := img.(type) {
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				fn(x - b.Min.X, y - b.Min.Y, uint16(g.GrayAt(x, y).Y))
+			}
+		}
+	case *image.Gray16:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				fn(x - b.Min.X, y - b.Min.Y, g.Gray16At(x, y).Y)
+			}
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				v := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y
+				fn(x - b.Min.X, y - b.Min.Y, v >> shift)
+			}
+		}
+	}
+}
+
+// Histogram counts the pixels of img at each intensity. It has 256 bins for
+// 8 bit images and 65536 for 16 bit images.
+func Histogram(img image.Image) []int {
+	hist := make([]int, 1 << uint(Depth(img)))
+	Values(img, func(x, y int, v uint16) {
+		hist[v]++
+	})
+	return hist
+}
+
+// Intensity is the stats of each channel of img (see ChannelIntensity).
+func Intensity(img image.Image) []*Stats {
+	stats, _ := ChannelIntensity(ingest.ImageRows(img))
+	return stats
+}
+
+// ChannelIntensity is the stats of each channel of src, read a row at a time.
+// The stats are in the units of src (see ingest.RowSource.Depth).
+func ChannelIntensity(src ingest.RowSource) ([]*Stats, error) {
+	ch := src.Channels()
+	shift := uint(16 - src.Depth())
+	hists := make([][]int, ch)
+	for c := range hists {
+		hists[c] = make([]int, 1 << uint(src.Depth()))
+	}
+	err := src.Rows(func(y int, row []uint16) error {
+		for i, v := range row {
+			hists[i % ch][v >> shift]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := []string{"gray"}
+	if ch == 3 {
+		names = []string{"red", "green", "blue"}
+	}
+	stats := make([]*Stats, 0, ch)
+	for c, hist := range hists {
+		s := histogramStats(hist)
+		s.Channel = names[c]
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+func histogramStats(hist []int) *Stats {
+	s := &Stats{Min: -1}
+	var sum float64
+	for v, n := range hist {
+		if n == 0 {
+			continue
+		}
+		if s.Min < 0 {
+			s.Min = float64(v)
+		}
+		s.Max = float64(v)
+		s.Pixels += n
+		sum += float64(v) * float64(n)
+	}
+	if s.Pixels == 0 {
+		s.Min = 0
+		s.Percentiles = make([]float64, len(Percentiles))
+		return s
+	}
+	s.IntegratedDensity = sum
+	s.Mean = sum / float64(s.Pixels)
+	s.Median = percentile(hist, s.Pixels, 50)
+	s.Percentiles = make([]float64, 0, len(Percentiles))
+	for _, p := range Percentiles {
+		s.Percentiles = append(s.Percentiles, percentile(hist, s.Pixels, p))
+	}
+	s.Saturated = float64(hist[len(hist)-1]) / float64(s.Pixels)
+	return s
+}
+
+// percentile is the smallest value with at least p percent of the pixels at or
+// below it (the nearest rank method).
+func percentile(hist []int, pixels int, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(pixels)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := 0
+	for v, n := range hist {
+		seen += n
+		if seen >= rank {
+			return float64(v)
+		}
+	}
+	return float64(len(hist) - 1)
+}
+
+// StatsColumns are the names of the columns of Stats.Values.
+func StatsColumns() []string {
+	cols := []string{"channel", "pixels", "min", "max", "mean", "median"}
+	for _, p := range Percentiles {
+		cols = append(cols, fmt.Sprintf("p%g", p))
+	}
+	return append(cols, "integrated_density", "saturated_fraction")
+}
+
+func (s *Stats) Values() []string {
+	vals := []string{s.Channel, fmt.Sprint(s.Pixels), format(s.Min), format(s.Max), format(s.Mean), format(s.Median)}
+	for _, p := range s.Percentiles {
+		vals = append(vals, format(p))
+	}
+	return append(vals, format(s.IntegratedDensity), format(s.Saturated))
+}
+
+func format(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
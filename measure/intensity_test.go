@@ -0,0 +1,134 @@
+package measure
+
+import "testing"
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"golang.org/x/image/tiff"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+func TestIntensity(t *testing.T) {
+	// 0, 1, ..., 99 with the last pixel saturated
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	for i := 0; i < 100; i++ {
+		img.SetGray(i%10, i/10, color.Gray{uint8(i)})
+	}
+	img.SetGray(9, 9, color.Gray{255})
+	stats := Intensity(img)
+	if len(stats) != 1 || stats[0].Channel != "gray" {
+		t.Fatal("expected the gray channel got", stats)
+	}
+	s := stats[0]
+	if s.Pixels != 100 || s.Min != 0 || s.Max != 255 {
+		t.Fatal("unexpected pixels, min or max", s.Pixels, s.Min, s.Max)
+	}
+	if s.Median != 49 {
+		t.Fatal("expected a median of 49 got", s.Median)
+	}
+	if s.Percentiles[0] != 0 || s.Percentiles[len(s.Percentiles)-1] != 98 {
+		t.Fatal("unexpected percentiles", s.Percentiles)
+	}
+	if s.IntegratedDensity != 4950 - 99 + 255 {
+		t.Fatal("unexpected integrated density", s.IntegratedDensity)
+	}
+	if s.Saturated != .01 {
+		t.Fatal("expected 1% saturated got", s.Saturated)
+	}
+}
+
+func TestIntensity16(t *testing.T) {
+	img := image.NewGray16(image.Rect(0, 0, 2, 1))
+	img.SetGray16(0, 0, color.Gray16{1000})
+	img.SetGray16(1, 0, color.Gray16{3000})
+	s := Intensity(img)[0]
+	if s.Mean != 2000 || s.Saturated != 0 {
+		t.Fatal("unexpected mean or saturation", s.Mean, s.Saturated)
+	}
+}
+
+func TestIntensityChannels(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.SetRGBA(0, 0, color.RGBA{10, 255, 0, 255})
+	img.SetRGBA(1, 0, color.RGBA{30, 255, 0, 255})
+	stats := Intensity(img)
+	if len(stats) != 3 {
+		t.Fatal("expected 3 channels got", stats)
+	}
+	for i, expect := range []struct{channel string; mean, saturated float64}{
+		{"red", 20, 0},
+		{"green", 255, 1},
+		{"blue", 0, 0},
+	} {
+		s := stats[i]
+		if s.Channel != expect.channel || s.Mean != expect.mean || s.Saturated != expect.saturated {
+			t.Fatal("expected", expect, "got", s.Channel, s.Mean, s.Saturated)
+		}
+	}
+}
+
+func TestMeasureStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "measure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.tif")
+	img := image.NewGray16(image.Rect(0, 0, 4, 3))
+	for i := 0; i < 12; i++ {
+		img.SetGray16(i%4, i/4, color.Gray16{uint16(i*100)})
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tiff.Encode(f, img, nil)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	measured, stats := Measure([]*ingest.Image{{Path: path}}, nil, nil)
+	if len(measured) != 1 || len(stats) != 1 {
+		t.Fatal("expected one channel got", stats)
+	}
+	if s := stats[0]; s.Channel != "gray" || s.Pixels != 12 || s.Max != 1100 || s.Mean != 550 {
+		t.Fatal("unexpected stats", s)
+	}
+}
+
+func TestWriteStatsCSV(t *testing.T) {
+	images := []*ingest.Image{
+		{Path: "a.jpeg", Source: "a.tif", Metadata: ingest.Metadata{"stain": "DAPI", "region": "1"}},
+		{Path: "b.jpeg", Source: "b.tif", Page: 2, Metadata: ingest.Metadata{"stain": "FITC", "z": "2"}},
+	}
+	img := image.NewGray(image.Rect(0, 0, 1, 1))
+	img.SetGray(0, 0, color.Gray{7})
+	stats := []*Stats{Intensity(img)[0], Intensity(img)[0]}
+	buf := new(bytes.Buffer)
+	err := WriteStatsCSV(buf, images, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatal("expected a header and 2 rows got", lines)
+	}
+	if !strings.HasPrefix(lines[0], "region,stain,z,source,page,channel,pixels,min,max,mean,median,p1,") {
+		t.Fatal("unexpected header", lines[0])
+	}
+	if !strings.HasPrefix(lines[2], ",FITC,2,b.tif,2,gray,1,7,7,7,7,7,") {
+		t.Fatal("unexpected row", lines[2])
+	}
+}
@@ -0,0 +1,199 @@
+package measure
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+// Quality scores how usable a capture is.
+type Quality struct {
+	// the variance of the Laplacian of the image, in 8 bit units. sharp
+	// images have strong edges and so a high variance.
+	Focus float64
+	// the fraction of pixels at the largest value the image can hold. dark
+	// pixels are not counted, most of a fluorescence image is background.
+	Overexposed float64
+}
+
+// QualityCheck flags images which are out of focus or overexposed.
+type QualityCheck struct {
+	// images are compared to the others with the same value for On (eg.
+	// the same stain) as the focus varies a lot between stains. an image is
+	// flagged as blurry when its focus is below BlurRatio times the median
+	// focus of at least 3 images.
+	On string
+	BlurRatio float64
+	// images with more than MaxOverexposed of their pixels at the largest
+	// value are flagged as overexposed.
+	MaxOverexposed float64
+	// images with a focus below MinFocus fail the check. 0 passes every
+	// image.
+	MinFocus float64
+}
+
+func DefaultQualityCheck(on string) *QualityCheck {
+	return &QualityCheck{On: on, BlurRatio: .4, MaxOverexposed: .01}
+}
+
+// ImageQuality scores img.
+func ImageQuality(img image.Image) *Quality {
+	q, _ := RowQuality(ingest.ImageRows(img))
+	return q
+}
+
+// RowQuality scores src a row at a time. Only the last three rows are kept to
+// compute the Laplacian. Color images are scored on their luminance.
+func RowQuality(src ingest.RowSource) (*Quality, error) {
+	size := src.Size()
+	w, h := size.X, size.Y
+	ch := src.Channels()
+	shift := uint(16 - src.Depth())
+	max := uint16(1 << uint(src.Depth()) - 1)
+	// the rows above, at and below the row whose Laplacian is next
+	above, at, below := make([]float64, w), make([]float64, w), make([]float64, w)
+	overexposed := 0
+	var n, sum, sumSq float64
+	err := src.Rows(func(y int, row []uint16) error {
+		above, at, below = at, below, above
+		for x := 0; x < w; x++ {
+			v := row[x*ch]
+			if ch == 3 {
+				r, g, b := uint32(row[x*ch]), uint32(row[x*ch+1]), uint32(row[x*ch+2])
+				v = uint16((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+			}
+			// in 8 bit units whatever the depth
+			below[x] = float64(v) / 257
+			if v >> shift == max {
+				overexposed++
+			}
+		}
+		if y < 2 {
+			return nil
+		}
+		for x := 1; x < w - 1; x++ {
+			lap := 4*at[x] - at[x-1] - at[x+1] - above[x] - below[x]
+			n++
+			sum += lap
+			sumSq += lap*lap
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	q := &Quality{}
+	if w*h > 0 {
+		q.Overexposed = float64(overexposed) / float64(w*h)
+	}
+	if n > 0 {
+		mean := sum / n
+		q.Focus = sumSq/n - mean*mean
+	}
+	return q, nil
+}
+
+// Check scores the images (from their original data, corrected by corr and
+// streamed a row at a time) and notes the scores in their `focus` and
+// `overexposed` notes. Flagged images
+// get a `quality` note saying what is wrong with them. The images which fail
+// (see MinFocus) are returned separately. The scores are kept in a sidecar
+// next to each image so they are only computed once (see qualitySidecar).
+func (c *QualityCheck) Check(images []*ingest.Image, corr *ingest.Correction) (passed, failed []*ingest.Image) {
+	scores := make(map[*ingest.Image]*Quality, len(images))
+	groups := make(map[string][]float64)
+	for _, img := range images {
+		q, err := imageQuality(img, corr)
+		if err != nil {
+			log.Println("WARN", "could not score the quality of", img.Path, "because", err)
+			continue
+		}
+		scores[img] = q
+		groups[img.Meta()[c.On]] = append(groups[img.Meta()[c.On]], q.Focus)
+	}
+	medians := make(map[string]float64, len(groups))
+	for k, focus := range groups {
+		if len(focus) >= 3 {
+			sort.Float64s(focus)
+			medians[k] = focus[len(focus)/2]
+		}
+	}
+	for _, img := range images {
+		q, has := scores[img]
+		if !has {
+			passed = append(passed, img)
+			continue
+		}
+		img.SetNote("focus", strconv.FormatFloat(q.Focus, 'f', 1, 64))
+		img.SetNote("overexposed", fmt.Sprintf("%.2f%%", 100*q.Overexposed))
+		var flags []string
+		if median, has := medians[img.Meta()[c.On]]; has && q.Focus < c.BlurRatio*median {
+			flags = append(flags, "blurry")
+		}
+		if q.Overexposed > c.MaxOverexposed {
+			flags = append(flags, "overexposed")
+		}
+		if len(flags) > 0 {
+			img.SetNote("quality", strings.Join(flags, ", "))
+		}
+		if q.Focus < c.MinFocus {
+			failed = append(failed, img)
+		} else {
+			passed = append(passed, img)
+		}
+	}
+	return passed, failed
+}
+
+// qualityVersion is bumped whenever the scores change, so sidecars written
+// by an older version are not reused.
+const qualityVersion = 2
+
+// qualitySidecar is named for the scoring version and the references the
+// image is corrected with (see ingest.Correction.Key).
+func qualitySidecar(img *ingest.Image, corr *ingest.Correction) string {
+	sidecar := fmt.Sprintf("%v.quality-v%d", img.Path, qualityVersion)
+	if key := corr.Key(img.Meta()); key != "" {
+		sidecar += "-corrected-" + key
+	}
+	return sidecar
+}
+
+// imageQuality reads the quality of img from its sidecar, or scores it and
+// writes the sidecar.
+func imageQuality(img *ingest.Image, corr *ingest.Correction) (*Quality, error) {
+	sidecar := qualitySidecar(img, corr)
+	if bytes, err := ioutil.ReadFile(sidecar); err == nil {
+		q := &Quality{}
+		_, err = fmt.Sscan(string(bytes), &q.Focus, &q.Overexposed)
+		if err == nil {
+			return q, nil
+		}
+	}
+	var q *Quality
+	err := img.StreamOriginal(func(src ingest.RowSource) (err error) {
+		src, err = corr.CorrectRows(src, img.Meta())
+		if err != nil {
+			return err
+		}
+		q, err = RowQuality(src)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(sidecar, []byte(fmt.Sprintf("%v %v\n", format(q.Focus), format(q.Overexposed))), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
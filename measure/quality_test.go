@@ -0,0 +1,97 @@
+package measure
+
+import "testing"
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/disintegration/imaging"
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+func TestImageQuality(t *testing.T) {
+	sharp := spots(60, 60, []image.Point{{10, 10}, {30, 40}, {45, 15}}, 1)
+	blurred := imaging.Blur(sharp, 3)
+	qs, qb := ImageQuality(sharp), ImageQuality(blurred)
+	if qs.Focus <= 4*qb.Focus {
+		t.Fatal("expected the sharp image to score much higher", qs.Focus, qb.Focus)
+	}
+	if qs.Overexposed != 0 {
+		t.Fatal("expected nothing overexposed got", qs.Overexposed)
+	}
+	white := spots(10, 10, nil, 1)
+	for i := range white.Pix[:25] {
+		white.Pix[i] = 255
+	}
+	if q := ImageQuality(white); q.Overexposed != .25 {
+		t.Fatal("expected a quarter overexposed got", q.Overexposed)
+	}
+	if q := ImageQuality(image.NewGray(image.Rect(0, 0, 10, 10))); q.Overexposed != 0 {
+		t.Fatal("expected a black image to not be overexposed got", q.Overexposed)
+	}
+}
+
+func TestQualityCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quality")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sharp := spots(60, 60, []image.Point{{10, 10}, {30, 40}, {45, 15}}, 1)
+	var images []*ingest.Image
+	for i, img := range []image.Image{sharp, sharp, sharp, imaging.Blur(sharp, 3)} {
+		path := filepath.Join(dir, string('a' + rune(i)) + ".png")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = png.Encode(f, img)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, &ingest.Image{Path: path, Metadata: ingest.Metadata{"stain": "DAPI"}})
+	}
+	check := DefaultQualityCheck("stain")
+	passed, failed := check.Check(images, nil)
+	if len(passed) != 4 || len(failed) != 0 {
+		t.Fatal("without a minimum focus every image should pass")
+	}
+	for i, img := range passed {
+		if q := img.Note("quality"); (i == 3) != (q != "") || (q != "" && q != "blurry") {
+			t.Fatal("image", i, "unexpected quality", img.Notes)
+		}
+	}
+	check.MinFocus = ImageQuality(sharp).Focus / 2
+	passed, failed = check.Check(images, nil)
+	if len(passed) != 3 || len(failed) != 1 || failed[0] != images[3] {
+		t.Fatal("expected the blurred image to fail got", failed)
+	}
+}
+
+func TestQualitySidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quality")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flat := filepath.Join(dir, "flat.png")
+	if err := ioutil.WriteFile(flat, []byte("flat"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	corr := &ingest.Correction{Flats: []*ingest.Image{{Path: flat, Metadata: ingest.Metadata{"stain": "DAPI"}}}}
+	img := &ingest.Image{Path: filepath.Join(dir, "a.png"), Metadata: ingest.Metadata{"stain": "DAPI"}}
+	plain := qualitySidecar(img, nil)
+	if plain == img.Path + ".quality" {
+		t.Fatal("expected the sidecar to be versioned got", plain)
+	}
+	if corrected := qualitySidecar(img, corr); corrected == plain {
+		t.Fatal("expected the corrected scores in their own sidecar got", corrected)
+	}
+}
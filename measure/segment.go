@@ -0,0 +1,363 @@
+package measure
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/disintegration/imaging"
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+
+// Segmentation finds the objects (eg. nuclei) in an image: the connected
+// groups of pixels above a threshold.
+type Segmentation struct {
+	// the threshold in the units of the image (see Depth). 0 picks one
+	// with Otsu's method.
+	Threshold float64
+	// objects with fewer pixels than MinArea or more than MaxArea are
+	// ignored. a MaxArea of 0 means there is no maximum.
+	MinArea, MaxArea int
+	// only the images whose value for On (eg. stain) is one of Values are
+	// segmented, all of them when Values is empty. the mask overlays are
+	// named by appending "-mask" to their value for On.
+	On string
+	Values []string
+	// writes the mask overlays.
+	ingest.Previews
+}
+
+// Objects are the objects found in an image.
+type Objects struct {
+	// the threshold which was used.
+	Threshold float64
+	// the area in pixels of each object.
+	Areas []int
+	// the object each pixel is part of (1 based, row major), 0 for the
+	// background. nil when the objects were read back from a sidecar.
+	Labels []int32
+	Width, Height int
+}
+
+// ParseSegmentation parses 'otsu' or a threshold.
+func ParseSegmentation(s string) (*Segmentation, error) {
+	if s == "otsu" {
+		return &Segmentation{}, nil
+	}
+	t, err := strconv.ParseFloat(s, 64)
+	if err != nil || t <= 0 {
+		return nil, fmt.Errorf("expected 'otsu' or a threshold above 0 got '%v'", s)
+	}
+	return &Segmentation{Threshold: t}, nil
+}
+
+func (s *Segmentation) String() string {
+	t := "otsu"
+	if s.Threshold > 0 {
+		t = format(s.Threshold)
+	}
+	return fmt.Sprintf("%v-%d-%d", t, s.MinArea, s.MaxArea)
+}
+
+// Applies is true if img should be segmented.
+func (s *Segmentation) Applies(img *ingest.Image) bool {
+	if len(s.Values) == 0 {
+		return true
+	}
+	for _, v := range s.Values {
+		if img.Meta()[s.On] == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Objects) Count() int {
+	return len(o.Areas)
+}
+
+func (o *Objects) TotalArea() int {
+	total := 0
+	for _, a := range o.Areas {
+		total += a
+	}
+	return total
+}
+
+func (o *Objects) MeanArea() float64 {
+	if len(o.Areas) == 0 {
+		return 0
+	}
+	return float64(o.TotalArea()) / float64(len(o.Areas))
+}
+
+// Segment thresholds img and labels the 8-connected groups of pixels above
+// the threshold.
+func (s *Segmentation) Segment(img image.Image) *Objects {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	threshold := s.Threshold
+	if threshold <= 0 {
+		threshold = float64(Otsu(Histogram(img)))
+	}
+	above := make([]bool, w*h)
+	Values(img, func(x, y int, v uint16) {
+		above[y*w + x] = float64(v) > threshold
+	})
+	// union-find over provisional labels
+	parent := []int32{0}
+	find := func(l int32) int32 {
+		for parent[l] != l {
+			parent[l] = parent[parent[l]]
+			l = parent[l]
+		}
+		return l
+	}
+	union := func(a, b int32) int32 {
+		a, b = find(a), find(b)
+		if a < b {
+			parent[b] = a
+			return a
+		}
+		parent[a] = b
+		return b
+	}
+	labels := make([]int32, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !above[y*w + x] {
+				continue
+			}
+			var l int32
+			for _, d := range [][2]int{{-1, 0}, {-1, -1}, {0, -1}, {1, -1}} {
+				nx, ny := x + d[0], y + d[1]
+				if nx < 0 || ny < 0 || nx >= w {
+					continue
+				}
+				if n := labels[ny*w + nx]; n != 0 {
+					if l == 0 {
+						l = find(n)
+					} else {
+						l = union(l, n)
+					}
+				}
+			}
+			if l == 0 {
+				l = int32(len(parent))
+				parent = append(parent, l)
+			}
+			labels[y*w + x] = l
+		}
+	}
+	areas := make([]int, len(parent))
+	for i, l := range labels {
+		if l != 0 {
+			labels[i] = find(l)
+			areas[labels[i]]++
+		}
+	}
+	// renumber the objects which pass the size filter
+	final := make([]int32, len(parent))
+	o := &Objects{Threshold: threshold, Labels: labels, Width: w, Height: h}
+	for l := 1; l < len(areas); l++ {
+		a := areas[l]
+		if a == 0 || a < s.MinArea || (s.MaxArea > 0 && a > s.MaxArea) {
+			continue
+		}
+		o.Areas = append(o.Areas, a)
+		final[l] = int32(len(o.Areas))
+	}
+	for i, l := range labels {
+		labels[i] = final[l]
+	}
+	return o
+}
+
+// Otsu picks the threshold which best separates the histogram into two
+// classes (maximizing the variance between them). Pixels above the threshold
+// are the foreground.
+func Otsu(hist []int) int {
+	var total, sum float64
+	for v, n := range hist {
+		total += float64(n)
+		sum += float64(v) * float64(n)
+	}
+	var below, sumBelow, best float64
+	threshold := 0
+	for v, n := range hist {
+		below += float64(n)
+		if below == 0 {
+			continue
+		}
+		above := total - below
+		if above == 0 {
+			break
+		}
+		sumBelow += float64(v) * float64(n)
+		meanBelow := sumBelow / below
+		meanAbove := (sum - sumBelow) / above
+		between := below * above * (meanBelow - meanAbove) * (meanBelow - meanAbove)
+		if between > best {
+			best = between
+			threshold = v
+		}
+	}
+	return threshold
+}
+
+// MaskOverlay tints each object of o on a grayscale copy of img (usually the
+// preview, which may be smaller than the image which was segmented).
+func MaskOverlay(img image.Image, o *Objects) image.Image {
+	b := img.Bounds()
+	out := imaging.Grayscale(img)
+	if o.Labels == nil || o.Width == 0 || o.Height == 0 {
+		return out
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			l := o.Labels[(y*o.Height/b.Dy())*o.Width + x*o.Width/b.Dx()]
+			if l == 0 {
+				continue
+			}
+			tint := objectColor(int(l))
+			px := out.NRGBAAt(x, y)
+			out.SetNRGBA(x, y, color.NRGBA{
+				R: uint8((uint(px.R) + uint(tint.R)) / 2),
+				G: uint8((uint(px.G) + uint(tint.G)) / 2),
+				B: uint8((uint(px.B) + uint(tint.B)) / 2),
+				A: 0xff,
+			})
+		}
+	}
+	return out
+}
+
+var objectColors = []color.NRGBA{
+	{0xff, 0x40, 0x40, 0xff},
+	{0x40, 0xff, 0x40, 0xff},
+	{0x40, 0x80, 0xff, 0xff},
+	{0xff, 0xff, 0x40, 0xff},
+	{0xff, 0x40, 0xff, 0xff},
+	{0x40, 0xff, 0xff, 0xff},
+}
+
+func objectColor(label int) color.NRGBA {
+	return objectColors[(label - 1) % len(objectColors)]
+}
+
+// SegmentImages segments the images (see Applies) from their original data,
+// corrected by corr. Each segmented image gets its object count and mean
+// object area (in pixels) in its `objects` and `object-area` metadata. A mask
+// overlay image is added after each segmented image. It is the same as the
+// image except its value for On has "-mask" appended, so it can be a column
+// of the charts.
+func (s *Segmentation) SegmentImages(images []*ingest.Image, corr *ingest.Correction) []*ingest.Image {
+	out := make([]*ingest.Image, 0, 2*len(images))
+	for _, img := range images {
+		if !s.Applies(img) {
+			out = append(out, img)
+			continue
+		}
+		mask, err := s.segmentImage(img, corr)
+		if err != nil {
+			log.Println("WARN", "could not segment", img.Path, "because", err)
+			out = append(out, img)
+			continue
+		}
+		out = append(out, img, mask)
+	}
+	return out
+}
+
+func (s *Segmentation) segmentImage(img *ingest.Image, corr *ingest.Correction) (*ingest.Image, error) {
+	name := strings.TrimSuffix(img.Path, filepath.Ext(img.Path))
+	path := fmt.Sprintf("%v.mask-%v%v", name, s, s.PreviewExt())
+	o, err := readObjects(path + ".objects")
+	if err != nil {
+		pix, err := Load(img, corr)
+		if err != nil {
+			return nil, err
+		}
+		preview, err := ingest.LoadImage(img.Path)
+		if err != nil {
+			return nil, err
+		}
+		o = s.Segment(pix)
+		err = s.WritePreview(path, MaskOverlay(preview, o))
+		if err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+		err = writeObjects(path + ".objects", o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	img.SetNote("objects", strconv.Itoa(o.Count()))
+	img.SetNote("object-area", strconv.FormatFloat(o.MeanArea(), 'f', 1, 64))
+	mask := *img
+	mask.Path = path
+	mask.Source = ""
+	mask.Page = 0
+	mask.Metadata = make(ingest.Metadata, len(img.Meta()) + 1)
+	for k, v := range img.Meta() {
+		mask.Metadata[k] = v
+	}
+	if s.On == "" {
+		mask.Metadata["mask"] = "mask"
+	} else {
+		mask.Metadata[s.On] = img.Meta()[s.On] + "-mask"
+	}
+	return &mask, nil
+}
+
+// the sidecar of a mask holds the threshold then the area of each object.
+func writeObjects(path string, o *Objects) error {
+	parts := []string{format(o.Threshold)}
+	for _, a := range o.Areas {
+		parts = append(parts, strconv.Itoa(a))
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(parts, " ") + "\n"), 0644)
+}
+
+func readObjects(path string) (*Objects, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(string(bytes))
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("empty objects file %v", path)
+	}
+	o := &Objects{}
+	o.Threshold, err = strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts[1:] {
+		a, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, err
+		}
+		o.Areas = append(o.Areas, a)
+	}
+	return o, nil
+}
+
+// ObjectsColumns are the names of the columns of Objects.Values.
+func ObjectsColumns() []string {
+	return []string{"threshold", "objects", "total_area", "mean_area"}
+}
+
+func (o *Objects) Values() []string {
+	return []string{format(o.Threshold), strconv.Itoa(o.Count()), strconv.Itoa(o.TotalArea()), format(o.MeanArea())}
+}
@@ -0,0 +1,85 @@
+package measure
+
+import "testing"
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/timtadh/wide-view-microscopy/ingest"
+)
+
+func TestOtsu(t *testing.T) {
+	hist := make([]int, 256)
+	hist[20] = 100
+	hist[25] = 100
+	hist[200] = 50
+	hist[210] = 50
+	if th := Otsu(hist); th < 25 || th >= 200 {
+		t.Fatal("expected a threshold between the classes got", th)
+	}
+}
+
+func TestSegment(t *testing.T) {
+	// two 4x4 spots, a diagonal pair of pixels and a lone pixel
+	img := spots(40, 40, []image.Point{{5, 5}, {20, 30}}, 1)
+	img.Pix[10*40 + 30] = 250
+	img.Pix[11*40 + 31] = 250
+	img.Pix[35*40 + 2] = 250
+	o := (&Segmentation{}).Segment(img)
+	if o.Count() != 4 {
+		t.Fatal("expected 4 objects got", o.Count(), o.Areas)
+	}
+	if o.TotalArea() != 16 + 16 + 2 + 1 {
+		t.Fatal("unexpected total area", o.TotalArea())
+	}
+	if o.Labels[6*40 + 6] == 0 || o.Labels[6*40 + 6] == o.Labels[31*40 + 21] {
+		t.Fatal("expected the spots to be distinct objects")
+	}
+	filtered := (&Segmentation{Threshold: 100, MinArea: 2, MaxArea: 10}).Segment(img)
+	if filtered.Count() != 1 || filtered.Areas[0] != 2 {
+		t.Fatal("expected only the pair of pixels got", filtered.Areas)
+	}
+}
+
+func TestSegmentImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "1 DAPI.jpeg")
+	err = ingest.WriteJpeg(path, spots(40, 40, []image.Point{{5, 5}, {20, 30}, {30, 10}}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := []*ingest.Image{
+		{Path: path, Metadata: ingest.Metadata{"stain": "DAPI"}},
+		{Path: "other.jpeg", Metadata: ingest.Metadata{"stain": "FITC"}},
+	}
+	seg := &Segmentation{MinArea: 4, On: "stain", Values: []string{"DAPI"}}
+	for i := 0; i < 2; i++ {
+		// the second time the counts are read back from the mask's sidecar
+		segmented := seg.SegmentImages(images, nil)
+		if len(segmented) != 3 {
+			t.Fatal("expected a mask for DAPI only got", segmented)
+		}
+		if segmented[0].Note("objects") != "3" {
+			t.Fatal("expected 3 objects got", segmented[0].Meta())
+		}
+		mask := segmented[1]
+		if mask.Meta()["stain"] != "DAPI-mask" || mask.Note("objects") != "3" {
+			t.Fatal("unexpected mask metadata", mask.Meta())
+		}
+		if _, err := os.Stat(mask.Path); err != nil {
+			t.Fatal(err)
+		}
+		if segmented[2].Note("objects") != "" {
+			t.Fatal("FITC should not be segmented")
+		}
+	}
+}